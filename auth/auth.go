@@ -0,0 +1,198 @@
+// Package auth authenticates API clients and tells
+// what each of them is allowed to do.
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Scope is an operation a principal may be allowed to perform.
+type Scope string
+
+// known scopes
+const (
+	Create    Scope = "create"    // register streams
+	Publish   Scope = "publish"   // write to streams
+	Subscribe Scope = "subscribe" // read from streams
+	Delete    Scope = "delete"    // remove streams
+	List      Scope = "list"      // list streams by prefix
+	Admin     Scope = "admin"     // everything, including administration
+)
+
+// DefaultScopes are granted to credentials which don't list any,
+// e.g. the legacy `user:password|user:password` format.
+var DefaultScopes = []Scope{Create, Publish, Subscribe, Delete}
+
+// ParseScopes parses a comma separated list of scopes.
+func ParseScopes(val string) ([]Scope, error) {
+	var scopes []Scope
+	for _, s := range strings.Split(val, ",") {
+		scope := Scope(strings.TrimSpace(s))
+		switch scope {
+		case "":
+			continue
+		case Create, Publish, Subscribe, Delete, List, Admin:
+			scopes = append(scopes, scope)
+		default:
+			return nil, fmt.Errorf("Unknown scope '%s'", s)
+		}
+	}
+	return scopes, nil
+}
+
+// Principal is an authenticated client.
+type Principal struct {
+	Name     string
+	Scopes   []Scope
+	Prefixes []string // keys the principal is limited to, all if empty
+}
+
+// Allows tells whether the principal may access the given key.
+func (p *Principal) Allows(key string) bool {
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can tells whether the principal is allowed the given scope.
+func (p *Principal) Can(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// credential is a password granting a principal's scopes. A name
+// may have several of them, e.g. while rotating passwords.
+type credential struct {
+	Name     string  `json:"name"`
+	Password string  `json:"password"`
+	Scopes   []Scope `json:"scopes"`
+}
+
+// Credentials is a reloadable set of named credentials checked
+// against basic auth. It is safe for concurrent use.
+type Credentials struct {
+	sync.RWMutex
+	creds map[string][]credential
+	env   string // credentials from the environment
+	path  string // credentials file, reread by Reload
+}
+
+// New creates credentials from env and the file at path, either of
+// which may be empty.
+//
+// Both hold either a JSON array of `{"name", "password", "scopes"}`
+// objects, or the legacy `user:password|user:password` format (with
+// one credential per line in files) granting the DefaultScopes.
+func New(env string, path string) (*Credentials, error) {
+	c := &Credentials{env: env, path: path}
+	return c, c.Reload()
+}
+
+// Reload rereads the credentials file. Credentials are
+// left untouched if it can't be read or parsed.
+func (c *Credentials) Reload() error {
+	creds, err := parse(c.env)
+	if err != nil {
+		return err
+	}
+
+	if c.path != "" {
+		buf, err := ioutil.ReadFile(c.path)
+		if err != nil {
+			return err
+		}
+
+		file, err := parse(string(buf))
+		if err != nil {
+			return err
+		}
+		creds = append(creds, file...)
+	}
+
+	byName := make(map[string][]credential)
+	for _, cred := range creds {
+		byName[cred.Name] = append(byName[cred.Name], cred)
+	}
+
+	c.Lock()
+	c.creds = byName
+	c.Unlock()
+	return nil
+}
+
+func parse(val string) (creds []credential, err error) {
+	val = strings.TrimSpace(val)
+
+	if strings.HasPrefix(val, "[") {
+		if err := json.Unmarshal([]byte(val), &creds); err != nil {
+			return nil, err
+		}
+
+		for i, cred := range creds {
+			if cred.Name == "" || cred.Password == "" {
+				return nil, fmt.Errorf("Unable to create credentials for '%s'", cred.Name)
+			}
+			if cred.Scopes == nil {
+				creds[i].Scopes = DefaultScopes
+			}
+		}
+		return creds, nil
+	}
+
+	for _, line := range strings.FieldsFunc(val, func(r rune) bool { return r == '|' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("Unable to create credentials from '%s'", line)
+		}
+		creds = append(creds, credential{Name: parts[0], Password: parts[1], Scopes: DefaultScopes})
+	}
+	return creds, nil
+}
+
+// Empty tells whether there are no credentials at all.
+func (c *Credentials) Empty() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.creds) == 0
+}
+
+// Authenticate returns the principal of the request's basic
+// auth credentials, if they're valid.
+func (c *Credentials) Authenticate(r *http.Request) (*Principal, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, cred := range c.creds[user] {
+		if subtle.ConstantTimeCompare([]byte(cred.Password), []byte(pass)) == 1 {
+			return &Principal{Name: cred.Name, Scopes: cred.Scopes}, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func request(user, pass string) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth(user, pass)
+	return r
+}
+
+func TestLegacyCredentials(t *testing.T) {
+	creds, err := New("u:pass1|u:pass2|other:pass:with:colons", "")
+	assert.Nil(t, err)
+
+	for _, pass := range []string{"pass1", "pass2"} {
+		principal, ok := creds.Authenticate(request("u", pass))
+		assert.True(t, ok)
+		assert.Equal(t, "u", principal.Name)
+		assert.True(t, principal.Can(Create))
+		assert.False(t, principal.Can(Admin))
+	}
+
+	_, ok := creds.Authenticate(request("other", "pass:with:colons"))
+	assert.True(t, ok)
+
+	_, ok = creds.Authenticate(request("u", "pass3"))
+	assert.False(t, ok)
+
+	_, err = New("u:", "")
+	assert.NotNil(t, err)
+}
+
+func TestScopedCredentials(t *testing.T) {
+	creds, err := New(`[
+		{"name": "ci", "password": "s3cret", "scopes": ["create", "publish"]},
+		{"name": "ops", "password": "r00t", "scopes": ["admin"]}
+	]`, "")
+	assert.Nil(t, err)
+
+	ci, ok := creds.Authenticate(request("ci", "s3cret"))
+	assert.True(t, ok)
+	assert.True(t, ci.Can(Publish))
+	assert.False(t, ci.Can(Subscribe))
+
+	ops, _ := creds.Authenticate(request("ops", "r00t"))
+	assert.True(t, ops.Can(Delete))
+
+	_, err = New(`[{"name": "ci"}]`, "")
+	assert.NotNil(t, err)
+}
+
+func TestReload(t *testing.T) {
+	f, _ := ioutil.TempFile("", "creds")
+	defer os.Remove(f.Name())
+
+	ioutil.WriteFile(f.Name(), []byte("# rotating\nteam:old\nteam:new\n"), 0600)
+	creds, err := New("", f.Name())
+	assert.Nil(t, err)
+
+	_, ok := creds.Authenticate(request("team", "old"))
+	assert.True(t, ok)
+
+	ioutil.WriteFile(f.Name(), []byte("team:new\n"), 0600)
+	assert.Nil(t, creds.Reload())
+
+	_, ok = creds.Authenticate(request("team", "old"))
+	assert.False(t, ok)
+	_, ok = creds.Authenticate(request("team", "new"))
+	assert.True(t, ok)
+
+	// Broken files leave the credentials untouched.
+	ioutil.WriteFile(f.Name(), []byte("[broken"), 0600)
+	assert.NotNil(t, creds.Reload())
+	_, ok = creds.Authenticate(request("team", "new"))
+	assert.True(t, ok)
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("create, publish")
+	assert.Nil(t, err)
+	assert.Equal(t, []Scope{Create, Publish}, scopes)
+
+	_, err = ParseScopes("create,root")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,22 @@
+package auth
+
+import "net/http"
+
+// CertificateScopes are granted to clients presenting a trusted TLS
+// certificate, which are expected to be producers.
+var CertificateScopes = []Scope{Create, Publish}
+
+// AuthenticateCertificate authenticates a request by its verified TLS
+// client certificate, as the certificate subject's common name.
+func AuthenticateCertificate(r *http.Request) (*Principal, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = cert.SerialNumber.String()
+	}
+	return &Principal{Name: name, Scopes: CertificateScopes}, true
+}
@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA384 and SHA512
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// known errors
+var (
+	ErrInvalidJWT = errors.New("Invalid bearer token.")
+	ErrNoJWTKeys  = errors.New("No keys found.")
+)
+
+// Clock skew tolerated when checking `exp` and `nbf`.
+const leeway = time.Minute
+
+// JWTVerifier authenticates `Authorization: Bearer` JWTs signed with
+// HMAC (HS256, HS384, HS512), RSA (RS*, PS*) or ECDSA (ES*) keys.
+//
+// Tokens must expire: those without an `exp` claim are rejected. The
+// principal is named after the `sub` claim. Its scopes come from the
+// space separated `scope` claim, and the `prefixes` claim limits it to
+// keys starting with one of the listed prefixes.
+type JWTVerifier struct {
+	sync.RWMutex
+	secret   []byte                   // HMAC secret
+	keys     map[string][]interface{} // public keys by `kid`, "" for keys without one
+	path     string                   // PEM or JWKS file, reread by Reload
+	audience string                   // required `aud`, if any
+}
+
+// NewJWTVerifier creates a verifier from an HMAC secret and/or a file
+// holding PEM encoded public keys or certificates, or a JWKS document.
+// With an audience, tokens must list it in their `aud` claim.
+func NewJWTVerifier(secret string, path string, audience string) (*JWTVerifier, error) {
+	v := &JWTVerifier{secret: []byte(secret), path: path, audience: audience}
+	return v, v.Reload()
+}
+
+// Reload rereads the keys file. Keys are left
+// untouched if it can't be read or parsed.
+func (v *JWTVerifier) Reload() error {
+	if v.path == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+
+	var keys map[string][]interface{}
+	if strings.HasPrefix(strings.TrimSpace(string(buf)), "{") {
+		keys, err = parseJWKS(buf)
+	} else {
+		keys, err = parsePEM(buf)
+	}
+	if err != nil {
+		return err
+	}
+
+	v.Lock()
+	v.keys = keys
+	v.Unlock()
+	return nil
+}
+
+func parsePEM(buf []byte) (map[string][]interface{}, error) {
+	keys := make(map[string][]interface{})
+
+	for {
+		var block *pem.Block
+		if block, buf = pem.Decode(buf); block == nil {
+			break
+		}
+
+		var key interface{}
+		var err error
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		keys[""] = append(keys[""], key)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoJWTKeys
+	}
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(buf []byte) (map[string][]interface{}, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(buf, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]interface{})
+	for _, k := range jwks.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			keys[k.Kid] = append(keys[k.Kid], key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoJWTKeys
+	}
+	return keys, nil
+}
+
+// publicKey returns the RSA or EC key described by k,
+// or nil for other (e.g. symmetric) keys.
+func (k *jwk) publicKey() (interface{}, error) {
+	param := func(s string) (*big.Int, error) {
+		buf, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(buf) == 0 {
+			return nil, fmt.Errorf("Invalid key parameter in '%s'", k.Kid)
+		}
+		return new(big.Int).SetBytes(buf), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := param(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := param(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported curve '%s'", k.Crv)
+		}
+		x, err := param(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := param(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type claims struct {
+	Sub      string          `json:"sub"`
+	Exp      *int64          `json:"exp"`
+	Nbf      *int64          `json:"nbf"`
+	Aud      json.RawMessage `json:"aud"`
+	Scope    string          `json:"scope"`
+	Prefixes []string        `json:"prefixes"`
+}
+
+// Authenticate returns the principal of the request's bearer
+// token, if it's a valid JWT.
+func (v *JWTVerifier) Authenticate(r *http.Request) (*Principal, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, false
+	}
+
+	principal, err := v.Verify(strings.TrimPrefix(auth, "Bearer "))
+	return principal, err == nil
+}
+
+// Verify checks the signature and validity of a JWT
+// and returns the principal it stands for.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	if !v.verifySignature(h, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidJWT
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	now := time.Now()
+	if c.Exp == nil || now.After(time.Unix(*c.Exp, 0).Add(leeway)) {
+		return nil, ErrInvalidJWT
+	}
+	if c.Nbf != nil && now.Before(time.Unix(*c.Nbf, 0).Add(-leeway)) {
+		return nil, ErrInvalidJWT
+	}
+	if v.audience != "" && !c.hasAudience(v.audience) {
+		return nil, ErrInvalidJWT
+	}
+
+	principal := &Principal{Name: c.Sub, Prefixes: c.Prefixes}
+	for _, s := range strings.Fields(c.Scope) {
+		if scopes, err := ParseScopes(s); err == nil {
+			principal.Scopes = append(principal.Scopes, scopes...)
+		}
+	}
+	return principal, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// `aud` is either a single audience or an array of them.
+func (c *claims) hasAudience(audience string) bool {
+	var single string
+	if json.Unmarshal(c.Aud, &single) == nil {
+		return single == audience
+	}
+
+	var many []string
+	json.Unmarshal(c.Aud, &many)
+	for _, aud := range many {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+var hashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// verifySignature only tries keys of the kind the algorithm calls
+// for, so e.g. a public key can't be used as an HMAC secret.
+func (v *JWTVerifier) verifySignature(h header, signed, sig []byte) bool {
+	if len(h.Alg) != 5 {
+		return false
+	}
+
+	hash, ok := hashes[h.Alg[2:]]
+	if !ok || !hash.Available() {
+		return false
+	}
+
+	if h.Alg[:2] == "HS" {
+		if len(v.secret) == 0 {
+			return false
+		}
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+
+	digest := hash.New()
+	digest.Write(signed)
+	sum := digest.Sum(nil)
+
+	v.RLock()
+	keys, ok := v.keys[h.Kid]
+	if !ok {
+		keys = v.keys[""]
+	}
+	v.RUnlock()
+
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			switch h.Alg[:2] {
+			case "RS":
+				if rsa.VerifyPKCS1v15(key, hash, sum, sig) == nil {
+					return true
+				}
+			case "PS":
+				if rsa.VerifyPSS(key, hash, sum, sig, nil) == nil {
+					return true
+				}
+			}
+
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if h.Alg[:2] != "ES" || len(sig) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, sum, r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
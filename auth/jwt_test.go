@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Signs claims expiring in an hour unless they say otherwise,
+// or don't expire with a nil "exp".
+func sign(t *testing.T, alg string, kid string, key interface{}, c map[string]interface{}) string {
+	if exp, ok := c["exp"]; !ok {
+		c["exp"] = time.Now().Add(time.Hour).Unix()
+	} else if exp == nil {
+		delete(c, "exp")
+	}
+
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	b, _ := json.Marshal(c)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(b)
+
+	hash := hashes[alg[2:]]
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, sum)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	assert.Nil(t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func tempFile(content []byte) string {
+	f, _ := ioutil.TempFile("", "keys")
+	f.Write(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestJWTHMAC(t *testing.T) {
+	v, err := NewJWTVerifier("s3cret", "", "")
+	assert.Nil(t, err)
+
+	token := sign(t, "HS256", "", []byte("s3cret"), map[string]interface{}{
+		"sub":      "builder",
+		"scope":    "publish subscribe unknown",
+		"prefixes": []string{"app/"},
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	})
+
+	principal, err := v.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "builder", principal.Name)
+	assert.Equal(t, []Scope{Publish, Subscribe}, principal.Scopes)
+	assert.True(t, principal.Allows("app/1/2"))
+	assert.False(t, principal.Allows("other/1/2"))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	_, ok := v.Authenticate(r)
+	assert.True(t, ok)
+
+	for _, token := range []string{
+		sign(t, "HS256", "", []byte("other"), map[string]interface{}{"sub": "builder"}),
+		sign(t, "HS256", "", []byte("s3cret"), map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		sign(t, "HS256", "", []byte("s3cret"), map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}),
+		sign(t, "HS256", "", []byte("s3cret"), map[string]interface{}{"sub": "builder", "exp": nil}),
+		"not.a.jwt",
+	} {
+		_, err := v.Verify(token)
+		assert.Equal(t, ErrInvalidJWT, err)
+	}
+}
+
+func TestJWTPEM(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := tempFile(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	defer os.Remove(path)
+
+	v, err := NewJWTVerifier("", path, "busl")
+	assert.Nil(t, err)
+
+	principal, err := v.Verify(sign(t, "RS256", "", key, map[string]interface{}{"sub": "svc", "aud": []string{"busl"}}))
+	assert.Nil(t, err)
+	assert.Equal(t, "svc", principal.Name)
+
+	// Wrong audience.
+	_, err = v.Verify(sign(t, "RS256", "", key, map[string]interface{}{"sub": "svc", "aud": "other"}))
+	assert.Equal(t, ErrInvalidJWT, err)
+
+	// The public key can't be used as an HMAC secret.
+	pub, _ := ioutil.ReadFile(path)
+	_, err = v.Verify(sign(t, "HS256", "", pub, map[string]interface{}{"sub": "svc", "aud": "busl"}))
+	assert.Equal(t, ErrInvalidJWT, err)
+}
+
+func TestJWTJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+			{"kty": "oct", "kid": "ignored"},
+		},
+	})
+	path := tempFile(jwks)
+	defer os.Remove(path)
+
+	v, err := NewJWTVerifier("", path, "")
+	assert.Nil(t, err)
+
+	_, err = v.Verify(sign(t, "RS512", "rsa-1", rsaKey, map[string]interface{}{"sub": "a"}))
+	assert.Nil(t, err)
+
+	_, err = v.Verify(sign(t, "ES256", "ec-1", ecKey, map[string]interface{}{"sub": "b"}))
+	assert.Nil(t, err)
+
+	// Signed with the EC key but claiming the RSA one.
+	_, err = v.Verify(sign(t, "ES256", "rsa-1", ecKey, map[string]interface{}{"sub": "b"}))
+	assert.Equal(t, ErrInvalidJWT, err)
+
+	_, err = v.Verify(sign(t, "HS256", "", []byte(""), map[string]interface{}{"sub": "c"}))
+	assert.Equal(t, ErrInvalidJWT, err)
+}
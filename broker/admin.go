@@ -0,0 +1,283 @@
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// Keys shared by every busl instance for administration.
+const (
+	streamsID  = "admin:streams"   // registered channels, scored by creation time
+	instanceID = "admin:instances" // instances which reported their connections
+	controlID  = "admin:control"   // commands to every instance
+)
+
+func connectionsID(instance string) string {
+	return "admin:connections:" + instance
+}
+
+// Connection is a publisher or subscriber connected to an instance.
+type Connection struct {
+	ID         string    `json:"id"`
+	Key        string    `json:"key"`
+	Kind       string    `json:"kind"` // publisher or subscriber
+	RemoteAddr string    `json:"remote_addr"`
+	Since      time.Time `json:"since"`
+	Instance   string    `json:"instance"`
+}
+
+// Stream describes a channel registered with the broker.
+type Stream struct {
+	Key     string
+	Bytes   int64
+	Done    bool          // whether the writer closed the channel
+	Created time.Time     // zero for channels registered before it was tracked
+	TTL     time.Duration // until the channel expires without activity
+}
+
+// ReportConnections records the connections of an instance, which
+// are forgotten after ttl unless reported again.
+func ReportConnections(instance string, conns []Connection, ttl time.Duration) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(connectionsID(instance))
+	for _, c := range conns {
+		buf, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		args = args.Add(c.ID, buf)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", connectionsID(instance))
+	if len(conns) > 0 {
+		conn.Send("HMSET", args...)
+		conn.Send("PEXPIRE", connectionsID(instance), int64(ttl/time.Millisecond))
+	}
+	conn.Send("SADD", instanceID, instance)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Connections returns the connections reported by every instance.
+func Connections() ([]Connection, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	instances, err := redis.Strings(conn.Do("SMEMBERS", instanceID))
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []Connection
+	for _, instance := range instances {
+		fields, err := redis.StringMap(conn.Do("HGETALL", connectionsID(instance)))
+		if err != nil {
+			return nil, err
+		}
+
+		// Gone, or idle: it'll add itself back when it isn't.
+		if len(fields) == 0 {
+			conn.Do("SREM", instanceID, instance)
+			continue
+		}
+
+		for _, field := range fields {
+			var c Connection
+			if err := json.Unmarshal([]byte(field), &c); err != nil {
+				util.CountWithData("broker.connections.error", 1, "instance=%s error=%q", instance, err)
+				continue
+			}
+			conns = append(conns, c)
+		}
+	}
+	return conns, nil
+}
+
+// Streams returns up to limit of the most recently registered
+// channels, newest first, skipping the ones which expired.
+func Streams(limit int) ([]Stream, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("ZREVRANGE", streamsID, 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	streams, _, err := streamInfos(conn, keys)
+	return streams, err
+}
+
+// StreamInfo describes a registered channel.
+func StreamInfo(key string) (Stream, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	stream, err := streamInfo(conn, key)
+	if err != nil {
+		return stream, err
+	}
+
+	stream.Created = created(conn, key)
+	return stream, nil
+}
+
+// Returns when a channel was registered, if it was tracked.
+func created(conn redis.Conn, key string) time.Time {
+	ms, err := redis.Int64(conn.Do("ZSCORE", streamsID, key))
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Describes the channels with the given keys in a single round trip,
+// returning the keys of those which aren't registered separately.
+// Created is zero for channels registered before it was tracked.
+func streamInfos(conn redis.Conn, keys []string) (streams []Stream, unregistered []string, err error) {
+	for _, key := range keys {
+		channel := channel(key)
+		conn.Send("PTTL", channel.id())
+		conn.Send("STRLEN", channel.id())
+		conn.Send("EXISTS", channel.doneID())
+		conn.Send("ZSCORE", streamsID, key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	// Every reply is received, even after an error,
+	// to leave the connection usable.
+	for _, key := range keys {
+		ttl, ttlErr := redis.Int64(conn.Receive())
+		bytes, bytesErr := redis.Int64(conn.Receive())
+		done, doneErr := redis.Bool(conn.Receive())
+		ms, msErr := redis.Int64(conn.Receive())
+		for _, e := range []error{ttlErr, bytesErr, doneErr} {
+			if err == nil {
+				err = e
+			}
+		}
+
+		if ttlErr != nil || ttl == -2 {
+			unregistered = append(unregistered, key)
+			continue
+		}
+
+		stream := Stream{Key: key, Bytes: bytes, Done: done, TTL: time.Duration(ttl) * time.Millisecond}
+		if msErr == nil {
+			stream.Created = time.Unix(0, ms*int64(time.Millisecond))
+		}
+		streams = append(streams, stream)
+	}
+	return streams, unregistered, err
+}
+
+func streamInfo(conn redis.Conn, key string) (Stream, error) {
+	channel := channel(key)
+
+	conn.Send("MULTI")
+	conn.Send("PTTL", channel.id())
+	conn.Send("STRLEN", channel.id())
+	conn.Send("EXISTS", channel.doneID())
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return Stream{}, err
+	}
+
+	ttl, err := redis.Int64(list[0], nil)
+	if err != nil || ttl == -2 {
+		return Stream{}, ErrNotRegistered
+	}
+
+	stream := Stream{Key: key, TTL: time.Duration(ttl) * time.Millisecond}
+	stream.Bytes, _ = redis.Int64(list[1], nil)
+	stream.Done, _ = redis.Bool(list[2], nil)
+	return stream, nil
+}
+
+// Commands sent to every instance.
+const (
+	CommandClose      = "close"      // the stream was closed, its publishers disconnected
+	CommandDisconnect = "disconnect" // the connection was dropped
+)
+
+// CloseStream closes a channel as its writer would, and has
+// every instance disconnect the channel's publishers.
+func CloseStream(key string) error {
+	if !NewRedisRegistrar().IsRegistered(key) {
+		return ErrNotRegistered
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	w := &writer{channel: channel(key)}
+	w.ttl, _ = w.channel.limits(conn)
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	_, err := conn.Do("PUBLISH", controlID, CommandClose+" "+key)
+	return err
+}
+
+// Disconnect has every instance drop the connection with the given ID.
+func Disconnect(id string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", controlID, CommandDisconnect+" "+id)
+	return err
+}
+
+// ReceiveCommands calls fn with the commands sent to every
+// instance, e.g. `close` and the key of the closed stream. It
+// returns when the connection to redis fails, or once stop is closed.
+func ReceiveCommands(stop <-chan struct{}, fn func(command, arg string)) error {
+	psc := redis.PubSubConn{Conn: redisPool.Get()}
+	defer psc.Close()
+
+	if err := psc.Subscribe(controlID); err != nil {
+		return err
+	}
+
+	// Unsubscribing wakes up the pending Receive. It's done
+	// before the connection is closed.
+	received, unsubscribed := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(received)
+		<-unsubscribed
+	}()
+	go func() {
+		defer close(unsubscribed)
+		select {
+		case <-stop:
+			psc.Unsubscribe()
+		case <-received:
+		}
+	}()
+
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.Message:
+			parts := strings.SplitN(string(msg.Data), " ", 2)
+			if len(parts) == 2 {
+				fn(parts[0], parts[1])
+			}
+		case redis.Subscription:
+			if msg.Count == 0 {
+				return nil
+			}
+		case error:
+			return msg
+		}
+	}
+}
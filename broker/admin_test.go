@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreams(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	registrar := NewRedisRegistrar()
+	registrar.Register(uuid)
+
+	w, _ := NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	stream, err := StreamInfo(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), stream.Bytes)
+	assert.False(t, stream.Done)
+	assert.True(t, stream.TTL > 0)
+	assert.WithinDuration(t, time.Now(), stream.Created, time.Minute)
+
+	// The newest come first.
+	streams, err := Streams(1)
+	assert.Nil(t, err)
+	if assert.Len(t, streams, 1) {
+		assert.Equal(t, uuid, streams[0].Key)
+		assert.Equal(t, int64(5), streams[0].Bytes)
+		assert.Equal(t, stream.Created, streams[0].Created)
+	}
+
+	assert.Nil(t, CloseStream(uuid))
+	stream, _ = StreamInfo(uuid)
+	assert.True(t, stream.Done)
+
+	_, err = StreamInfo("nope")
+	assert.Equal(t, ErrNotRegistered, err)
+	assert.Equal(t, ErrNotRegistered, CloseStream("nope"))
+}
+
+func TestConnections(t *testing.T) {
+	instance, _ := util.NewUUID()
+	conn := Connection{ID: "1", Key: "1/2/3", Kind: "subscriber", Instance: instance}
+	assert.Nil(t, ReportConnections(instance, []Connection{conn}, time.Minute))
+
+	conns, err := Connections()
+	assert.Nil(t, err)
+	assert.Contains(t, conns, conn)
+
+	// Reporting again replaces them.
+	assert.Nil(t, ReportConnections(instance, nil, time.Minute))
+	conns, _ = Connections()
+	assert.NotContains(t, conns, conn)
+}
+
+func TestCommands(t *testing.T) {
+	commands := make(chan string, 1)
+	stop := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- ReceiveCommands(stop, func(command, arg string) {
+			if arg == "test-connection" {
+				select {
+				case commands <- command:
+				default:
+				}
+			}
+		})
+	}()
+
+	// Wait for the subscription.
+	for received := false; !received; {
+		Disconnect("test-connection")
+		select {
+		case command := <-commands:
+			assert.Equal(t, CommandDisconnect, command)
+			received = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	close(stop)
+	select {
+	case err := <-stopped:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("commands weren't stopped")
+	}
+}
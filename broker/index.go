@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// indexID is a sorted set of the registered channels, all scored 0 so
+// they're ordered by key and can be looked up by prefix with ZRANGEBYLEX.
+// expiriesID scores them by when they expire unless renewed, in unix
+// milliseconds, so Sweep only looks at those which might have.
+const (
+	indexID    = "index:streams"
+	expiriesID = "index:expiries"
+)
+
+// Channels are swept from the indexes in batches of sweepBatch.
+const sweepBatch = 1000
+
+// Removes an expired channel from the indexes, telling whether
+// it was still in them.
+func forget(conn redis.Conn, key string) bool {
+	conn.Send("MULTI")
+	conn.Send("ZREM", indexID, key)
+	conn.Send("ZREM", streamsID, key)
+	conn.Send("ZREM", expiriesID, key)
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false
+	}
+	removed, _ := redis.Int(list[1], nil)
+	return removed == 1
+}
+
+// Sweep removes the channels which expired from the indexes and
+// returns their keys. Every instance may sweep, but each expired
+// channel is only returned by the sweep which removed it. Only the
+// channels due to expire are looked at: those still alive, e.g.
+// renewed without being scored again, are scored by their TTL.
+func Sweep() (expired []string, err error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for {
+		now := time.Now()
+		keys, err := redis.Strings(conn.Do("ZRANGEBYSCORE", expiriesID, "-inf", millis(now), "LIMIT", 0, sweepBatch))
+		if err != nil {
+			return expired, err
+		}
+
+		streams, unregistered, err := streamInfos(conn, keys)
+		if err != nil {
+			return expired, err
+		}
+
+		for _, key := range unregistered {
+			if forget(conn, key) {
+				expired = append(expired, key)
+			}
+		}
+
+		conn.Send("MULTI")
+		for _, stream := range streams {
+			ttl := stream.TTL
+			if ttl <= 0 {
+				ttl = time.Duration(redisChannelExpire) * time.Second
+			}
+			conn.Send("ZADD", expiriesID, millis(now.Add(ttl)), stream.Key)
+		}
+		if _, err := conn.Do("EXEC"); err != nil {
+			return expired, err
+		}
+
+		if len(keys) < sweepBatch {
+			return expired, nil
+		}
+	}
+}
+
+// Listings scan up to listScanFactor times as many keys as they
+// list, so that expired ones left in the index don't make them
+// unbounded.
+const listScanFactor = 10
+
+// ListStreams returns up to limit registered channels whose keys start
+// with prefix, in order, starting after the key `after` if it isn't
+// empty. next is the key to continue after if there are further
+// channels to list, or might be: listings stop early rather than
+// scanning too many expired channels.
+func ListStreams(prefix, after string, limit int) (streams []Stream, next string, err error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	start, end := "-", "+"
+	if prefix != "" {
+		// 0xff never appears in UTF-8 keys.
+		start, end = "["+prefix, "["+prefix+"\xff"
+	}
+	if after != "" && after >= prefix {
+		start = "(" + after
+	}
+
+	// One more than the limit is listed to tell whether there are
+	// more, skipping the ones which expired.
+	for scanned := 0; len(streams) <= limit; {
+		if scanned >= listScanFactor*(limit+1) {
+			return streams, start[1:], nil
+		}
+
+		count := limit + 1 - len(streams)
+		keys, err := redis.Strings(conn.Do("ZRANGEBYLEX", indexID, start, end, "LIMIT", 0, count))
+		if err != nil {
+			return nil, "", err
+		}
+		scanned += len(keys)
+
+		// Those which expired are left for Sweep to report.
+		infos, _, err := streamInfos(conn, keys)
+		if err != nil {
+			return nil, "", err
+		}
+		streams = append(streams, infos...)
+
+		if len(keys) < count {
+			break
+		}
+		start = "(" + keys[len(keys)-1]
+	}
+
+	if len(streams) > limit {
+		return streams[:limit], streams[limit-1].Key, nil
+	}
+	return streams, "", nil
+}
@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListStreams(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	registrar := NewRedisRegistrar()
+	for _, key := range []string{"c", "a", "b/1", "b/2"} {
+		registrar.Register(uuid + "/" + key)
+	}
+	registrar.Register(uuid + "-other")
+
+	keys := func(streams []Stream) (keys []string) {
+		for _, stream := range streams {
+			keys = append(keys, stream.Key)
+		}
+		return keys
+	}
+
+	streams, next, err := ListStreams(uuid+"/", "", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, uuid+"/b/2", next)
+	assert.Equal(t, []string{uuid + "/a", uuid + "/b/1", uuid + "/b/2"}, keys(streams))
+	assert.False(t, streams[0].Created.IsZero())
+
+	streams, next, _ = ListStreams(uuid+"/", uuid+"/b/2", 3)
+	assert.Equal(t, "", next)
+	assert.Equal(t, []string{uuid + "/c"}, keys(streams))
+
+	streams, next, _ = ListStreams(uuid+"/b/", "", 3)
+	assert.Equal(t, "", next)
+	assert.Equal(t, []string{uuid + "/b/1", uuid + "/b/2"}, keys(streams))
+
+	// Expired streams are skipped.
+	conn := redisPool.Get()
+	conn.Do("DEL", channel(uuid+"/a").id())
+	conn.Close()
+
+	streams, next, _ = ListStreams(uuid+"/", "", 3)
+	assert.Equal(t, "", next)
+	assert.Equal(t, []string{uuid + "/b/1", uuid + "/b/2", uuid + "/c"}, keys(streams))
+}
+
+func TestListStreamsScanLimit(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	registrar := NewRedisRegistrar()
+	conn := redisPool.Get()
+	for i := 0; i < 2*listScanFactor+1; i++ {
+		key := fmt.Sprintf("%s/%02d", uuid, i)
+		registrar.Register(key)
+		conn.Do("DEL", channel(key).id())
+	}
+	registrar.Register(uuid + "/live")
+	conn.Close()
+
+	// Listings stop after scanning too many expired streams,
+	// to be continued after the last one scanned.
+	streams, next, err := ListStreams(uuid+"/", "", 1)
+	assert.Nil(t, err)
+	assert.Empty(t, streams)
+	assert.Equal(t, fmt.Sprintf("%s/%02d", uuid, 2*listScanFactor-1), next)
+
+	streams, next, _ = ListStreams(uuid+"/", next, 1)
+	assert.Equal(t, "", next)
+	assert.Equal(t, 1, len(streams))
+	assert.Equal(t, uuid+"/live", streams[0].Key)
+}
+
+func TestSweep(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	registrar := NewRedisRegistrar()
+	registrar.Register(uuid + "/live")
+	registrar.Register(uuid + "/expired")
+
+	// Expired, and due to.
+	conn := redisPool.Get()
+	conn.Do("DEL", channel(uuid+"/expired").id())
+	conn.Do("ZADD", expiriesID, 0, uuid+"/expired")
+	conn.Close()
+
+	expired, err := Sweep()
+	assert.Nil(t, err)
+	assert.Contains(t, expired, uuid+"/expired")
+	assert.NotContains(t, expired, uuid+"/live")
+
+	// Only reported once.
+	expired, _ = Sweep()
+	assert.NotContains(t, expired, uuid+"/expired")
+
+	streams, _, _ := ListStreams(uuid+"/", "", 10)
+	assert.Equal(t, 1, len(streams))
+}
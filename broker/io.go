@@ -3,28 +3,57 @@ package broker
 import (
 	"errors"
 	"io"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
 )
 
 type writer struct {
-	channel channel
+	channel  channel
+	offset   int64     // offset of the next byte written, as of the last write
+	ttl      int       // seconds the channel lives without activity
+	maxBytes int64     // quota of the channel, unlimited if 0
+	marked   time.Time // when the last mark was appended
+	parent   trace.SpanContext
 }
 
+// Writers append at most one mark per markInterval to the timeline:
+// later writes share the arrival time of the last marked one.
+var markInterval = 100 * time.Millisecond
+
 // known errors
 var (
 	ErrNotRegistered = errors.New("Channel is not registered.")
+	ErrQuotaExceeded = errors.New("Channel quota exceeded.")
 )
 
+// IOOptions tweak how readers and writers go about their channel.
+type IOOptions struct {
+	TraceParent trace.SpanContext // reads or writes are traced under it
+}
+
 // NewWriter creates a new redis channel writer
 func NewWriter(key string) (io.WriteCloser, error) {
-	if !NewRedisRegistrar().IsRegistered(key) {
-		return nil, ErrNotRegistered
+	return NewWriterWithOptions(key, IOOptions{})
+}
+
+// NewWriterWithOptions creates a new redis channel writer with opts.
+func NewWriterWithOptions(key string, opts IOOptions) (io.WriteCloser, error) {
+	size, err := Size(key)
+	if err != nil {
+		return nil, err
 	}
 
-	return &writer{channel(key)}, nil
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	w := &writer{channel: channel(key), offset: size, parent: opts.TraceParent}
+	w.ttl, w.maxBytes = w.channel.limits(conn)
+	return w, nil
 }
 
 func (w *writer) Close() error {
@@ -32,39 +61,99 @@ func (w *writer) Close() error {
 	defer conn.Close()
 
 	conn.Send("MULTI")
-	conn.Send("EXPIRE", w.channel.id(), redisKeyExpire)
-	conn.Send("SETEX", w.channel.doneID(), redisChannelExpire, []byte{1})
+	w.channel.expire(conn, redisKeyExpire)
+	conn.Send("SETEX", w.channel.doneID(), w.ttl, []byte{1})
 	conn.Send("PUBLISH", w.channel.killID(), 1)
 	_, err := conn.Do("EXEC")
 	return err
 }
 
-func (w *writer) Write(p []byte) (int, error) {
+// Write appends p to the channel, along with a mark of its arrival
+// time on the channel's timeline unless one was appended less than
+// markInterval ago. Writes beyond the channel's quota are cut short
+// with ErrQuotaExceeded.
+func (w *writer) Write(p []byte) (n int, err error) {
+	if w.parent.IsValid() {
+		span := trace.Start(w.parent, "broker.write")
+		span.SetAttribute("key", string(w.channel))
+		span.SetAttribute("offset", strconv.FormatInt(w.offset, 10))
+		defer func() {
+			span.SetAttribute("bytes", strconv.Itoa(n))
+			span.SetError(err)
+			span.Finish()
+		}()
+	}
+
+	defer func(offset int64) {
+		util.Debug("broker.write", "key", string(w.channel), "offset", offset, "bytes", n, "error", err)
+	}(w.offset)
+
+	var quotaErr error
+	if w.maxBytes > 0 && w.offset+int64(len(p)) > w.maxBytes {
+		if w.offset >= w.maxBytes {
+			return 0, ErrQuotaExceeded
+		}
+		p, quotaErr = p[:w.maxBytes-w.offset], ErrQuotaExceeded
+	}
+
 	conn := redisPool.Get()
 	defer conn.Close()
 
+	arrived := time.Now()
 	conn.Send("MULTI")
 	conn.Send("APPEND", w.channel.id(), p)
-	conn.Send("EXPIRE", w.channel.id(), redisChannelExpire)
+	w.channel.expire(conn, w.ttl)
 	conn.Send("DEL", w.channel.doneID())
 	conn.Send("PUBLISH", w.channel.id(), 1)
 
-	_, err := conn.Do("EXEC")
-	return len(p), err
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	size, err := redis.Int64(list[0], nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Other writers may have appended to the channel too: p
+	// went right before its new size. The mark expires along
+	// with it, even when it creates the timeline.
+	w.offset = size
+	if arrived.Sub(w.marked) >= markInterval {
+		w.marked = arrived
+		conn.Send("MULTI")
+		conn.Send("APPEND", w.channel.timesID(), encodeMark(size-int64(len(p)), arrived))
+		conn.Send("EXPIRE", w.channel.timesID(), w.ttl)
+		if _, err := conn.Do("EXEC"); err != nil {
+			util.CountWithData("RedisBroker.mark.error", 1, "err=%s", err)
+		}
+	}
+	return len(p), quotaErr
 }
 
 type reader struct {
-	channel  channel
-	psc      redis.PubSubConn
-	offset   int64
-	replayed bool
-	closed   bool
-	mutex    *sync.Mutex
-	buffered bool
+	channel   channel
+	psc       redis.PubSubConn
+	offset    int64
+	replayed  bool
+	closed    bool
+	receiving bool // whether a Read is waiting for messages
+	mutex     *sync.Mutex
+	buffered  bool
+	finished  bool     // whether the writer closed the channel
+	ttl       int      // seconds the channel lives without activity
+	timeline  Timeline // marks fetched and not yet dropped
+	marks     int64    // number of marks fetched so far
+	parent    trace.SpanContext
 }
 
 // NewReader creates a new redis channel reader
 func NewReader(key string) (io.ReadCloser, error) {
+	return NewReaderWithOptions(key, IOOptions{})
+}
+
+// NewReaderWithOptions creates a new redis channel reader with opts.
+func NewReaderWithOptions(key string, opts IOOptions) (io.ReadCloser, error) {
 	if !NewRedisRegistrar().IsRegistered(key) {
 		return nil, ErrNotRegistered
 	}
@@ -76,7 +165,12 @@ func NewReader(key string) (io.ReadCloser, error) {
 	rd := &reader{
 		channel: channel,
 		psc:     psc,
-		mutex:   &sync.Mutex{}}
+		mutex:   &sync.Mutex{},
+		parent:  opts.TraceParent}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	rd.ttl, _ = channel.limits(conn)
 
 	return rd, nil
 }
@@ -109,7 +203,28 @@ func (r *reader) Read(p []byte) (n int, err error) {
 		return n, err
 	}
 
-	switch msg := r.psc.Receive().(type) {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return 0, io.EOF
+	}
+	r.receiving = true
+	r.mutex.Unlock()
+
+	msg := r.psc.Receive()
+
+	r.mutex.Lock()
+	r.receiving = false
+	closed := r.closed
+	r.mutex.Unlock()
+
+	// Closed while waiting, the connection is ours to close.
+	if closed {
+		r.psc.Close()
+		return 0, io.EOF
+	}
+
+	switch msg := msg.(type) {
 	case redis.Message:
 	case redis.PMessage:
 		return r.read(msg, p)
@@ -167,23 +282,46 @@ func (r *reader) read(msg redis.PMessage, p []byte) (n int, err error) {
 	return n, err
 }
 
-func (r *reader) fetch(length int) ([]byte, error) {
+func (r *reader) fetch(length int) (data []byte, err error) {
+	if r.parent.IsValid() {
+		span := trace.Start(r.parent, "broker.fetch")
+		span.SetAttribute("key", string(r.channel))
+		span.SetAttribute("offset", strconv.FormatInt(r.offset, 10))
+		defer func() {
+			span.SetAttribute("bytes", strconv.Itoa(len(data)))
+			if err != io.EOF {
+				span.SetError(err)
+			}
+			span.Finish()
+		}()
+	}
+
 	conn := redisPool.Get()
 	defer conn.Close()
 
 	start, end := r.offset, r.offset+int64(length)
 
+	// Marks of the timeline come along, for Timestamp.
 	conn.Send("MULTI")
 	conn.Send("GETRANGE", r.channel.id(), start, end-1)
 	conn.Send("STRLEN", r.channel.id())
 	conn.Send("EXISTS", r.channel.doneID())
-	conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
+	conn.Send("GETRANGE", r.channel.timesID(), r.marks*markSize, -1)
+	r.channel.expire(conn, r.ttl)
 
 	list, err := redis.Values(conn.Do("EXEC"))
-	data, err := redis.Bytes(list[0], err)
+	data, err = redis.Bytes(list[0], err)
 	size, err := redis.Int64(list[1], err)
 	done, err := redis.Bool(list[2], err)
+	marks, err := redis.Bytes(list[3], err)
 
+	if err == nil {
+		r.addMarks(ParseTimeline(marks))
+	}
+
+	r.mutex.Lock()
+	r.finished = done
+	r.mutex.Unlock()
 	if r.buffered = end < size; !r.buffered && done {
 		err = io.EOF
 	}
@@ -191,15 +329,63 @@ func (r *reader) fetch(length int) ([]byte, error) {
 	return data, err
 }
 
-func (r *reader) Close() error {
-	if r.closed {
-		return nil
+// Timestamp returns when the byte at offset was written, as of the
+// marks fetched along with it. Offsets are expected to be looked up
+// in increasing order: marks preceding offset are dropped.
+func (r *reader) Timestamp(offset int64) (time.Time, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	i := r.timeline.index(offset)
+	if i < 0 {
+		return time.Time{}, false
+	}
+
+	r.timeline = r.timeline[i:]
+	return r.timeline[0].Time, true
+}
+
+func (r *reader) addMarks(marks Timeline) {
+	if len(marks) == 0 {
+		return
 	}
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	r.timeline = append(r.timeline, marks...)
+	r.timeline.sort()
+	r.marks += int64(len(marks))
+}
+
+// State returns whether the channel is still `open` for writing
+// or `done`, as of the last read.
+func (r *reader) State() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.finished {
+		return "done"
+	}
+	return "open"
+}
+
+func (r *reader) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
 	r.closed = true
+
+	// Redigo connections can't be received from concurrently: wake
+	// up a Read waiting for messages, which closes the connection.
+	if r.receiving {
+		r.psc.PUnsubscribe()
+		return nil
+	}
+
 	r.psc.Unsubscribe()
 	return r.psc.Close()
 }
@@ -238,6 +424,15 @@ func NoContent(rd io.Reader, offset int64) bool {
 	return offset > (strlen - 1)
 }
 
+// Offset returns the offset of the next byte a broker writer writes,
+// i.e. the size of its channel when it was opened plus what it wrote.
+func Offset(w io.Writer) int64 {
+	if w, ok := w.(*writer); ok {
+		return w.offset
+	}
+	return 0
+}
+
 // RenewExpiry renews the channel expiration
 func RenewExpiry(rd io.Reader) {
 	r, ok := rd.(*reader)
@@ -249,6 +444,6 @@ func RenewExpiry(rd io.Reader) {
 	defer conn.Close()
 
 	conn.Send("MULTI")
-	conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
+	r.channel.expire(conn, r.ttl)
 	conn.Do("EXEC")
 }
@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// RateLimitError is returned when a limit has been reached.
+type RateLimitError struct {
+	RetryAfter time.Duration // when the request is likely to succeed again
+}
+
+func (e *RateLimitError) Error() string {
+	return "Too many requests."
+}
+
+// Subscriber slots are leased rather than held forever, so the
+// slots of a crashed dyno free up on their own.
+var (
+	leaseDuration      = time.Minute
+	leaseRenewInterval = leaseDuration / 3
+	leaseRetryAfter    = 5 * time.Second
+)
+
+func limitID(name string) string {
+	return "limit:" + name
+}
+
+// Throttle counts n against a limit per window shared by every busl
+// instance, e.g. bytes published per second. The request pushing the
+// count past the limit still goes through; once it is reached,
+// requests are refused until the window ends.
+func Throttle(name string, limit, n int64, window time.Duration) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	id := limitID(name)
+
+	// The window's counter is created with its expiry, in the same
+	// transaction as the count, so it can't be left without one.
+	conn.Send("MULTI")
+	conn.Send("SET", id, 0, "PX", int64(window/time.Millisecond), "NX")
+	conn.Send("INCRBY", id, n)
+	conn.Send("PTTL", id)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	var count, ttl int64
+	if _, err := redis.Scan(values[1:], &count, &ttl); err != nil {
+		return err
+	}
+
+	if count-n >= limit {
+		return &RateLimitError{RetryAfter: time.Duration(ttl) * time.Millisecond}
+	}
+	return nil
+}
+
+// Acquire takes one of limit slots shared by every busl instance,
+// e.g. the subscribers of a stream. The slot is kept until release
+// is called.
+func Acquire(name string, limit int) (release func(), err error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	uuid, err := util.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	id, member := limitID(name), string(uuid)
+	now := time.Now()
+
+	conn.Send("MULTI")
+	conn.Send("ZREMRANGEBYSCORE", id, "-inf", millis(now))
+	conn.Send("ZADD", id, millis(now.Add(leaseDuration)), member)
+	conn.Send("ZCARD", id)
+	conn.Send("PEXPIRE", id, int64(leaseDuration/time.Millisecond))
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := redis.Int(values[2], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if held > limit {
+		conn.Do("ZREM", id, member)
+		return nil, &RateLimitError{RetryAfter: leaseRetryAfter}
+	}
+
+	done := make(chan struct{})
+	go renewLease(id, member, done)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+
+			conn := redisPool.Get()
+			defer conn.Close()
+			conn.Do("ZREM", id, member)
+		})
+	}, nil
+}
+
+// renewLease extends a slot's lease until done is closed.
+func renewLease(id, member string, done <-chan struct{}) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			conn := redisPool.Get()
+			conn.Send("MULTI")
+			conn.Send("ZADD", id, millis(time.Now().Add(leaseDuration)), member)
+			conn.Send("PEXPIRE", id, int64(leaseDuration/time.Millisecond))
+			if _, err := conn.Do("EXEC"); err != nil {
+				util.CountWithData("broker.lease.renew.error", 1, "error=%s", err)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func millis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottle(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	name := "test:" + string(uuid)
+
+	assert.Nil(t, Throttle(name, 10, 6, time.Minute))
+
+	// The counter always expires with its window.
+	conn := redisPool.Get()
+	ttl, _ := redis.Int64(conn.Do("PTTL", limitID(name)))
+	conn.Close()
+	assert.True(t, ttl > 0 && ttl <= int64(time.Minute/time.Millisecond))
+
+	// Crossing the limit is allowed once...
+	assert.Nil(t, Throttle(name, 10, 6, time.Minute))
+
+	// ...but not after it's been reached.
+	err := Throttle(name, 10, 1, time.Minute)
+	limited, ok := err.(*RateLimitError)
+	assert.True(t, ok)
+	assert.True(t, limited.RetryAfter > 0)
+	assert.True(t, limited.RetryAfter <= time.Minute)
+
+	// Windows are independent.
+	assert.Nil(t, Throttle(name+":other", 10, 1, time.Minute))
+}
+
+func TestThrottleWindow(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	name := "test:" + string(uuid)
+
+	assert.Nil(t, Throttle(name, 1, 1, 50*time.Millisecond))
+	assert.NotNil(t, Throttle(name, 1, 1, 50*time.Millisecond))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, Throttle(name, 1, 1, 50*time.Millisecond))
+}
+
+func TestAcquire(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	name := "test:" + string(uuid)
+
+	first, err := Acquire(name, 2)
+	assert.Nil(t, err)
+	second, err := Acquire(name, 2)
+	assert.Nil(t, err)
+
+	_, err = Acquire(name, 2)
+	_, ok := err.(*RateLimitError)
+	assert.True(t, ok)
+
+	first()
+	first() // releasing twice is harmless
+	third, err := Acquire(name, 2)
+	assert.Nil(t, err)
+
+	_, err = Acquire(name, 2)
+	assert.NotNil(t, err)
+
+	second()
+	third()
+}
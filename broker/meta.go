@@ -0,0 +1,33 @@
+package broker
+
+import "github.com/garyburd/redigo/redis"
+
+// SetMeta sets a field of a channel's metadata, e.g. the
+// secrets to redact from it. Metadata expires with the channel.
+func SetMeta(key string, field string, value []byte) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	ttl, _ := channel.limits(conn)
+
+	conn.Send("MULTI")
+	conn.Send("HSET", channel.metaID(), field, value)
+	conn.Send("EXPIRE", channel.metaID(), ttl)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// GetMeta returns a field of a channel's metadata,
+// or nil if it isn't set.
+func GetMeta(key string, field string) ([]byte, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	buf, err := redis.Bytes(conn.Do("HGET", channel.metaID(), field))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return buf, err
+}
@@ -0,0 +1,27 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeta(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	registrar := NewRedisRegistrar()
+	registrar.Register(uuid)
+
+	value, err := GetMeta(uuid, "secrets")
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	assert.Nil(t, SetMeta(uuid, "secrets", []byte("hashed")))
+	value, _ = GetMeta(uuid, "secrets")
+	assert.Equal(t, []byte("hashed"), value)
+
+	// Registering the channel again starts afresh.
+	registrar.Register(uuid)
+	value, _ = GetMeta(uuid, "secrets")
+	assert.Nil(t, value)
+}
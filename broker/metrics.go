@@ -0,0 +1,29 @@
+package broker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/metrics"
+)
+
+var redisLatency = metrics.NewHistogram("busl_redis_command_duration_seconds", "Redis command latencies, by command.", "command")
+
+// timedConn records the latency of every command sent with Do. Commands
+// queued with Send are accounted for in the Do flushing them, e.g. EXEC.
+type timedConn struct {
+	redis.Conn
+}
+
+func (c *timedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(commandName, args...)
+
+	command := strings.ToUpper(commandName)
+	if command == "" {
+		command = "FLUSH"
+	}
+	redisLatency.Observe(time.Since(start).Seconds(), command)
+	return reply, err
+}
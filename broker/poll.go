@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"time"
+)
+
+// Poll returns up to max bytes of a channel from offset on, waiting
+// up to wait for some to be written when there are none yet. done
+// tells whether the channel was closed by its writer and entirely
+// read up to the returned bytes.
+func Poll(key string, offset int64, max int, wait time.Duration) (data []byte, done bool, err error) {
+	rd, err := NewReader(key)
+	if err != nil {
+		return nil, false, err
+	}
+	r := rd.(*reader)
+	r.Seek(offset, 0)
+
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, max)
+	results := make(chan result, 1)
+	go func() {
+		// Reads return nothing for subscription confirmations.
+		for {
+			n, err := r.Read(buf)
+			if n > 0 || err != nil {
+				results <- result{n, err}
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var res result
+	select {
+	case res = <-results:
+		r.Close()
+	case <-timer.C:
+		// Closing has the pending read return, with whatever
+		// it might have read in the meantime.
+		r.Close()
+		res = <-results
+	}
+
+	r.mutex.Lock()
+	closed, finished, buffered := r.closed, r.finished, r.buffered
+	r.mutex.Unlock()
+
+	if res.err != nil && res.n == 0 && !finished {
+		if closed {
+			return nil, false, nil
+		}
+		return nil, false, res.err
+	}
+	return buf[:res.n], finished && !buffered, nil
+}
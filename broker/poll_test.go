@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoll(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	registrar := NewRedisRegistrar()
+	registrar.Register(uuid)
+
+	w, _ := NewWriter(uuid)
+	w.Write([]byte("hello world"))
+
+	data, done, err := Poll(uuid, 0, 5, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.False(t, done)
+
+	data, done, _ = Poll(uuid, 5, 100, time.Second)
+	assert.Equal(t, " world", string(data))
+	assert.False(t, done)
+
+	// Nothing new: gives up after waiting.
+	start := time.Now()
+	data, done, err = Poll(uuid, 11, 100, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(data))
+	assert.False(t, done)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// Returns as soon as something's written.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("!"))
+	}()
+	data, _, _ = Poll(uuid, 11, 100, 5*time.Second)
+	assert.Equal(t, "!", string(data))
+
+	w.Close()
+	data, done, _ = Poll(uuid, 11, 100, time.Second)
+	assert.Equal(t, "!", string(data))
+	assert.True(t, done)
+
+	data, done, _ = Poll(uuid, 12, 100, 5*time.Second)
+	assert.Equal(t, 0, len(data))
+	assert.True(t, done)
+
+	_, _, err = Poll(uuid+"-nope", 0, 100, time.Second)
+	assert.Equal(t, ErrNotRegistered, err)
+}
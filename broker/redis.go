@@ -2,7 +2,6 @@ package broker
 
 import (
 	"flag"
-	"log"
 	"net/url"
 	"os"
 	"time"
@@ -31,7 +30,7 @@ func init() {
 func newPool(server *url.URL) *redis.Pool {
 	cleanServerURL := *server
 	cleanServerURL.User = nil
-	log.Printf("connecting to redis: %s", cleanServerURL.String())
+	util.Info("redis.connect", "url", cleanServerURL.String())
 	return &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 4 * time.Minute,
@@ -40,6 +39,7 @@ func newPool(server *url.URL) *redis.Pool {
 			if err != nil {
 				return
 			}
+			c = &timedConn{c}
 
 			if server.User == nil {
 				return
@@ -81,6 +81,38 @@ func (c channel) killID() string {
 	return string(c) + ":kill"
 }
 
+func (c channel) timesID() string {
+	return string(c) + ":times"
+}
+
+func (c channel) metaID() string {
+	return string(c) + ":meta"
+}
+
+// expire queues EXPIREs for the channel's buffer, its timeline and its
+// metadata, and scores it by when it expires for Sweep.
+func (c channel) expire(conn redis.Conn, seconds int) {
+	conn.Send("EXPIRE", c.id(), seconds)
+	conn.Send("EXPIRE", c.timesID(), seconds)
+	conn.Send("EXPIRE", c.metaID(), seconds)
+	conn.Send("ZADD", expiriesID, millis(time.Now().Add(time.Duration(seconds)*time.Second)), string(c))
+}
+
+// limits returns the TTL in seconds and the byte quota of a channel.
+// Channels registered without them live an hour and are unlimited.
+func (c channel) limits(conn redis.Conn) (ttl int, maxBytes int64) {
+	values, err := redis.Values(conn.Do("HMGET", c.metaID(), ttlField, maxBytesField))
+	if err != nil || len(values) != 2 {
+		return redisChannelExpire, 0
+	}
+
+	if ttl, err = redis.Int(values[0], nil); err != nil || ttl <= 0 {
+		ttl = redisChannelExpire
+	}
+	maxBytes, _ = redis.Int64(values[1], nil)
+	return ttl, maxBytes
+}
+
 // RedisRegistrar is a channel storing data on redis
 type RedisRegistrar struct{}
 
@@ -91,14 +123,45 @@ func NewRedisRegistrar() *RedisRegistrar {
 	return registrar
 }
 
+// Options tweak how a channel is kept in the broker.
+type Options struct {
+	TTL      time.Duration // how long the channel lives without activity, an hour by default
+	MaxBytes int64         // how much can be written to the channel, unlimited if 0
+}
+
+// Metadata fields holding the options of a channel.
+const (
+	ttlField      = "ttl"
+	maxBytesField = "max_bytes"
+)
+
 // Register registers the new channel
 func (rr *RedisRegistrar) Register(channelName string) (err error) {
+	return rr.RegisterWithOptions(channelName, Options{})
+}
+
+// RegisterWithOptions registers the new channel with the given
+// options, which are kept in the channel's metadata.
+func (rr *RedisRegistrar) RegisterWithOptions(channelName string, opts Options) (err error) {
 	conn := redisPool.Get()
 	defer conn.Close()
 
 	channel := channel(channelName)
 
-	_, err = conn.Do("SETEX", channel.id(), redisChannelExpire, make([]byte, 0))
+	ttl := redisChannelExpire
+	if opts.TTL > 0 {
+		ttl = int((opts.TTL + time.Second - 1) / time.Second)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SETEX", channel.id(), ttl, make([]byte, 0))
+	conn.Send("DEL", channel.timesID(), channel.metaID())
+	conn.Send("HMSET", channel.metaID(), ttlField, ttl, maxBytesField, opts.MaxBytes)
+	conn.Send("EXPIRE", channel.metaID(), ttl)
+	conn.Send("ZADD", streamsID, millis(time.Now()), channelName)
+	conn.Send("ZADD", indexID, 0, channelName)
+	conn.Send("ZADD", expiriesID, millis(time.Now().Add(time.Duration(ttl)*time.Second)), channelName)
+	_, err = conn.Do("EXEC")
 	if err != nil {
 		util.CountWithData("RedisRegistrar.Register.error", 1, "error=%s", err)
 		return
@@ -130,3 +193,60 @@ func Get(key string) ([]byte, error) {
 	channel := channel(key)
 	return redis.Bytes(conn.Do("GET", channel.id()))
 }
+
+// tailChunkSize is how much of a channel's buffer is fetched per
+// GETRANGE while scanning backwards for newlines.
+const tailChunkSize = 32 * 1024
+
+// Size returns the number of bytes written to a channel so far.
+func Size(key string) (int64, error) {
+	if !NewRedisRegistrar().IsRegistered(key) {
+		return 0, ErrNotRegistered
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	return redis.Int64(conn.Do("STRLEN", channel.id()))
+}
+
+// LineOffset returns the offset at which the last n lines of a channel
+// start. A trailing newline terminates the last line rather than
+// starting a new, empty one.
+func LineOffset(key string, n int64) (int64, error) {
+	size, err := Size(key)
+	if err != nil || n <= 0 {
+		return size, err
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+
+	for end := size; end > 0; {
+		start := end - tailChunkSize
+		if start < 0 {
+			start = 0
+		}
+
+		buf, err := redis.Bytes(conn.Do("GETRANGE", channel.id(), start, end-1))
+		if err != nil {
+			return 0, err
+		}
+
+		for i := len(buf) - 1; i >= 0; i-- {
+			pos := start + int64(i)
+			if buf[i] != '\n' || pos == size-1 {
+				continue
+			}
+			if n--; n == 0 {
+				return pos + 1, nil
+			}
+		}
+		end = start
+	}
+
+	return 0, nil
+}
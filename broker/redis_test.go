@@ -2,7 +2,9 @@ package broker
 
 import (
 	"testing"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/heroku/busl/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -44,3 +46,61 @@ func TestRegisteredNoError(t *testing.T) {
 	_, err = NewWriter(uuid)
 	assert.Nil(t, err)
 }
+
+func TestLineOffset(t *testing.T) {
+	uuid := setup()
+
+	w, _ := NewWriter(uuid)
+	w.Write([]byte("one\ntwo\n"))
+	w.Write([]byte("three\nfour\n"))
+
+	data := map[int64]int64{0: 19, 1: 14, 2: 8, 3: 4, 4: 0, 10: 0}
+	for lines, expected := range data {
+		offset, err := LineOffset(uuid, lines)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, offset)
+	}
+
+	// Without a trailing newline the partial line counts as the last one.
+	w.Write([]byte("fi"))
+	offset, _ := LineOffset(uuid, 1)
+	assert.Equal(t, int64(19), offset)
+
+	size, err := Size(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(21), size)
+}
+
+func TestLineOffsetNotRegistered(t *testing.T) {
+	_, uuid := newRegUUID()
+
+	_, err := LineOffset(uuid, 1)
+	assert.Equal(t, ErrNotRegistered, err)
+}
+
+func TestRegisterWithOptions(t *testing.T) {
+	reg, uuid := newRegUUID()
+	reg.RegisterWithOptions(uuid, Options{TTL: time.Minute, MaxBytes: 5})
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ttl, _ := redis.Int(conn.Do("TTL", channel(uuid).id()))
+	assert.True(t, ttl > 0 && ttl <= 60)
+
+	w, _ := NewWriter(uuid)
+	n, err := w.Write([]byte("hello world"))
+	assert.Equal(t, 5, n)
+	assert.Equal(t, ErrQuotaExceeded, err)
+
+	n, err = w.Write([]byte("!"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrQuotaExceeded, err)
+
+	data, _ := Get(uuid)
+	assert.Equal(t, []byte("hello"), data)
+
+	// Writes keep the channel's own TTL.
+	ttl, _ = redis.Int(conn.Do("TTL", channel(uuid).id()))
+	assert.True(t, ttl > 0 && ttl <= 60)
+}
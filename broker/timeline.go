@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Writes append fixed size marks to the channel's timeline: the
+// offset of their first byte followed by their arrival time in
+// nanoseconds, both as big endian int64s. Concurrent writers may
+// append them slightly out of order.
+const markSize = 16
+
+// Mark records when the write starting at Offset arrived.
+type Mark struct {
+	Offset int64
+	Time   time.Time
+}
+
+// Timeline is an index of write arrival times ordered by offset.
+type Timeline []Mark
+
+func encodeMark(offset int64, t time.Time) []byte {
+	buf := make([]byte, markSize)
+	binary.BigEndian.PutUint64(buf[:8], uint64(offset))
+	binary.BigEndian.PutUint64(buf[8:], uint64(t.UnixNano()))
+	return buf
+}
+
+// ParseTimeline decodes a timeline as stored in the broker (or as
+// archived next to a stream's output), ordered by offset. Trailing
+// partial marks are ignored.
+func ParseTimeline(buf []byte) Timeline {
+	t := make(Timeline, 0, len(buf)/markSize)
+	for ; len(buf) >= markSize; buf = buf[markSize:] {
+		t = append(t, Mark{
+			Offset: int64(binary.BigEndian.Uint64(buf[:8])),
+			Time:   time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:16]))).UTC(),
+		})
+	}
+	t.sort()
+	return t
+}
+
+func (t Timeline) sort() {
+	sort.SliceStable(t, func(i, j int) bool { return t[i].Offset < t[j].Offset })
+}
+
+// index returns the index of the mark of the write containing
+// offset, or -1 if offset precedes the timeline.
+func (t Timeline) index(offset int64) int {
+	return sort.Search(len(t), func(i int) bool { return t[i].Offset > offset }) - 1
+}
+
+// At returns the arrival time of the write containing offset.
+func (t Timeline) At(offset int64) (time.Time, bool) {
+	if i := t.index(offset); i >= 0 {
+		return t[i].Time, true
+	}
+	return time.Time{}, false
+}
+
+// Since returns the offset of the first write which arrived at or
+// after ts. It returns false if nothing was written since.
+func (t Timeline) Since(ts time.Time) (int64, bool) {
+	i := sort.Search(len(t), func(i int) bool { return !t[i].Time.Before(ts) })
+	if i == len(t) {
+		return 0, false
+	}
+	return t[i].Offset, true
+}
+
+// GetTimeline returns the raw timeline of a channel.
+func GetTimeline(key string) ([]byte, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	buf, err := redis.Bytes(conn.Do("GET", channel.timesID()))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return buf, err
+}
+
+// SinceOffset returns the offset of the first byte written to a
+// channel at or after ts, or the current size of the channel if
+// nothing was written since.
+func SinceOffset(key string, ts time.Time) (int64, error) {
+	size, err := Size(key)
+	if err != nil {
+		return 0, err
+	}
+
+	buf, err := GetTimeline(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset, ok := ParseTimeline(buf).Since(ts); ok {
+		return offset, nil
+	}
+	return size, nil
+}
@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeline(t *testing.T) {
+	t0 := time.Date(2016, 9, 7, 10, 0, 0, 0, time.UTC)
+	buf := append(encodeMark(0, t0), encodeMark(5, t0.Add(time.Second))...)
+	buf = append(buf, encodeMark(11, t0.Add(2*time.Second))...)
+
+	timeline := ParseTimeline(buf)
+	assert.Len(t, timeline, 3)
+
+	ts, ok := timeline.At(4)
+	assert.True(t, ok)
+	assert.Equal(t, t0, ts)
+
+	ts, _ = timeline.At(5)
+	assert.Equal(t, t0.Add(time.Second), ts)
+
+	ts, _ = timeline.At(100)
+	assert.Equal(t, t0.Add(2*time.Second), ts)
+
+	offset, ok := timeline.Since(t0.Add(500 * time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), offset)
+
+	_, ok = timeline.Since(t0.Add(time.Minute))
+	assert.False(t, ok)
+
+	// Partial marks are ignored
+	assert.Len(t, ParseTimeline(buf[:20]), 1)
+
+	// Marks appended out of order are sorted.
+	timeline = ParseTimeline(append(encodeMark(5, t0), encodeMark(0, t0)...))
+	assert.Equal(t, int64(0), timeline[0].Offset)
+}
+
+func TestReaderTimestamp(t *testing.T) {
+	defer func(interval time.Duration) { markInterval = interval }(markInterval)
+	markInterval = time.Millisecond
+
+	uuid := setup()
+
+	w, _ := NewWriter(uuid)
+	before := time.Now()
+	w.Write([]byte("busl"))
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	w.Write([]byte(" hello"))
+	w.Close()
+
+	r, _ := NewReader(uuid)
+	defer r.Close()
+	ioutil.ReadAll(r)
+
+	ts, ok := r.(*reader).Timestamp(0)
+	assert.True(t, ok)
+	assert.True(t, !ts.Before(before) && ts.Before(middle))
+
+	ts, ok = r.(*reader).Timestamp(4)
+	assert.True(t, ok)
+	assert.False(t, ts.Before(middle))
+
+	offset, err := SinceOffset(uuid, middle)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), offset)
+
+	offset, _ = SinceOffset(uuid, time.Now())
+	assert.Equal(t, int64(10), offset)
+}
+
+func TestWriterAppendsToExisting(t *testing.T) {
+	uuid := setup()
+
+	w, _ := NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Close()
+
+	// A second writer keeps the timeline aligned with the buffer.
+	w, _ = NewWriter(uuid)
+	w.Write([]byte(" hello"))
+
+	buf, _ := GetTimeline(uuid)
+	timeline := ParseTimeline(buf)
+	assert.Len(t, timeline, 2)
+	assert.Equal(t, int64(4), timeline[1].Offset)
+}
+
+func TestWriterCoalescesMarks(t *testing.T) {
+	uuid := setup()
+
+	w, _ := NewWriter(uuid)
+	for i := 0; i < 10; i++ {
+		w.Write([]byte("busl"))
+	}
+	w.Close()
+
+	buf, _ := GetTimeline(uuid)
+	assert.Len(t, ParseTimeline(buf), 1)
+}
+
+func TestMarksExpire(t *testing.T) {
+	uuid := setup()
+
+	w, _ := NewWriter(uuid)
+	w.Write([]byte("busl"))
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ttl, _ := redis.Int(conn.Do("TTL", channel(uuid).timesID()))
+	assert.True(t, ttl > 0)
+	w.Close()
+}
+
+func TestConcurrentWritersMarks(t *testing.T) {
+	defer func(interval time.Duration) { markInterval = interval }(markInterval)
+	markInterval = 0
+
+	uuid := setup()
+
+	// Both writers open the channel empty.
+	w1, _ := NewWriter(uuid)
+	w2, _ := NewWriter(uuid)
+	w1.Write([]byte("busl"))
+	w2.Write([]byte(" hello"))
+	w1.Write([]byte("!"))
+	w1.Close()
+	w2.Close()
+
+	buf, _ := GetTimeline(uuid)
+	timeline := ParseTimeline(buf)
+	if assert.Len(t, timeline, 3) {
+		assert.Equal(t, []int64{0, 4, 10}, []int64{timeline[0].Offset, timeline[1].Offset, timeline[2].Offset})
+	}
+	assert.Equal(t, int64(11), Offset(w1))
+}
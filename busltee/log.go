@@ -5,17 +5,29 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+
+	"github.com/heroku/busl/util"
 )
 
 var out io.Writer
 
-// OpenLogs configures the log file
-func OpenLogs(logFile, logPrefix string) {
+// OpenLogs configures the log file, its format (logfmt or
+// json) and level.
+func OpenLogs(logFile, logPrefix, logFormat, logLevel string) error {
 	out = output(logFile)
 
 	log.SetPrefix(logPrefix + " ")
 	log.SetOutput(out)
 	log.SetFlags(0)
+
+	if logLevel != "" {
+		level, err := util.ParseLevel(logLevel)
+		if err != nil {
+			return err
+		}
+		util.SetLogLevel(level)
+	}
+	return util.SetLogFormat(logFormat)
 }
 
 // CloseLogs closes an open log file
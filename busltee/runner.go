@@ -2,10 +2,10 @@ package busltee
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -13,18 +13,24 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/util"
 )
 
 // Config holds the runner configuration
 type Config struct {
-	Insecure  bool
-	Timeout   float64
-	Retry     int
-	URL       string
-	Args      []string
-	LogPrefix string
-	LogFile   string
-	RequestID string
+	Insecure    bool
+	Timeout     float64
+	Retry       int
+	URL         string
+	Args        []string
+	LogPrefix   string
+	LogFile     string
+	LogFormat   string // logfmt or json
+	LogLevel    string
+	RequestID   string
+	TraceParent string // W3C traceparent the POST is traced under
 }
 
 // Run creates the stdin listener and forwards logs to URI
@@ -32,24 +38,26 @@ func Run(url string, args []string, conf *Config) (exitCode int) {
 	defer monitor("busltee.busltee", time.Now())
 
 	reader, writer := io.Pipe()
-	done := post(url, reader, conf)
+	body := newStatusBody(reader)
+	done := post(url, body, conf)
 
 	if err := run(args, writer, writer); err != nil {
-		log.Printf("count#busltee.exec.error=1 error=%v", err.Error())
+		util.CountWithData("busltee.exec.error", 1, "error=%q", err.Error())
 		exitCode = exitStatus(err)
 	}
+	body.exited(exitCode)
 
 	select {
 	case <-done:
 	case <-time.After(time.Second):
-		log.Printf("count#busltee.exec.upload.timeout=1")
+		util.Count("busltee.exec.upload.timeout")
 	}
 
 	return exitCode
 }
 
 func monitor(subject string, ts time.Time) {
-	log.Printf("%s.time time=%f", subject, time.Now().Sub(ts).Seconds())
+	util.Info(subject+".time", "duration", time.Now().Sub(ts))
 }
 
 func post(url string, reader io.Reader, conf *Config) chan struct{} {
@@ -57,11 +65,11 @@ func post(url string, reader io.Reader, conf *Config) chan struct{} {
 
 	go func() {
 		if err := stream(url, reader, conf); err != nil {
-			log.Printf("count#busltee.stream.error=1 error=%v", err.Error())
+			util.CountWithData("busltee.stream.error", 1, "error=%q", err.Error())
 			// Prevent writes from blocking.
 			io.Copy(ioutil.Discard, reader)
 		} else {
-			log.Printf("count#busltee.stream.success=1")
+			util.Count("busltee.stream.success")
 		}
 		close(done)
 	}()
@@ -74,7 +82,7 @@ func stream(url string, stdin io.Reader, conf *Config) (err error) {
 		if err = streamNoRetry(url, stdin, conf); !isTimeout(err) {
 			return err
 		}
-		log.Printf("count#busltee.stream.retry")
+		util.Count("busltee.stream.retry")
 	}
 	return err
 }
@@ -85,7 +93,7 @@ func streamNoRetry(url string, stdin io.Reader, conf *Config) error {
 	defer monitor("busltee.stream", time.Now())
 
 	if url == "" {
-		log.Printf("count#busltee.stream.missingurl")
+		util.Count("busltee.stream.missingurl")
 		return errMissingURL
 	}
 
@@ -97,13 +105,22 @@ func streamNoRetry(url string, stdin io.Reader, conf *Config) error {
 	// it from being closed prematurely (and thus allowing writes
 	// on the other end of the pipe to work).
 	req, err := http.NewRequest("POST", url, ioutil.NopCloser(stdin))
+	if err != nil {
+		return err
+	}
+
+	if body, ok := stdin.(*statusBody); ok {
+		req.Trailer = body.trailer
+	}
+
 	if conf.RequestID != "" {
 		req.Header.Set("Request-Id", conf.RequestID)
 	}
 
-	if err != nil {
-		return err
-	}
+	// Traced as a child of the job running busltee, if any.
+	span := trace.Start(trace.ParseTraceParent(conf.TraceParent), "busltee.stream")
+	defer span.Finish()
+	trace.Inject(req, span.Context)
 
 	res, err := tr.RoundTrip(req)
 	if res != nil {
@@ -156,6 +173,43 @@ func deliverSignals(cmd *exec.Cmd) {
 	}()
 }
 
+// statusBody is the body of the POST, which ends with the exit
+// status of the command as the `Busl-Status` trailer.
+type statusBody struct {
+	io.Reader
+	trailer http.Header
+	status  chan []byte
+}
+
+func newStatusBody(r io.Reader) *statusBody {
+	return &statusBody{
+		Reader:  r,
+		trailer: http.Header{"Busl-Status": nil},
+		status:  make(chan []byte, 1),
+	}
+}
+
+// Reports the exit code of the command, once its output is all written.
+func (b *statusBody) exited(exitCode int) {
+	status, _ := json.Marshal(map[string]interface{}{"exit_code": exitCode})
+	b.status <- status
+}
+
+func (b *statusBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF && b.status != nil {
+		// The output ends as the command exits, right before
+		// its exit code is known.
+		select {
+		case status := <-b.status:
+			b.trailer.Set("Busl-Status", string(status))
+		case <-time.After(time.Second):
+		}
+		b.status = nil
+	}
+	return n, err
+}
+
 func isTimeout(err error) bool {
 	e, ok := err.(net.Error)
 	return ok && e.Timeout()
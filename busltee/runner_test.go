@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/heroku/busl/trace"
 )
 
 var conf = &Config{Timeout: 1}
@@ -140,6 +142,38 @@ func TestRequestID(t *testing.T) {
 
 }
 
+func TestTraceParent(t *testing.T) {
+	post := make(chan string, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		post <- r.Header.Get("traceparent")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	config := &Config{
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	if code := Run(server.URL, []string{"printf", "hello"}, config); code != 0 {
+		t.Fatalf("Expected exit code to be 0, got %d", code)
+	}
+
+	select {
+	case result := <-post:
+		sc := trace.ParseTraceParent(result)
+		if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("Expected the POST to be traced under %s, got %s", config.TraceParent, result)
+		}
+		if sc.SpanID.String() == "00f067aa0ba902b7" {
+			t.Fatalf("Expected the POST to have its own span, got %s", result)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("POST channel got no response")
+	}
+}
+
 func fauxBusl() (*httptest.Server, chan []byte) {
 	post := make(chan []byte, 10)
 
@@ -156,3 +190,29 @@ func fauxBusl() (*httptest.Server, chan []byte) {
 	server := httptest.NewServer(mux)
 	return server, post
 }
+
+func TestRunStatus(t *testing.T) {
+	trailer := make(chan string, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		trailer <- r.Trailer.Get("Busl-Status")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if code := Run(server.URL, []string{"sh", "-c", "echo hello; exit 3"}, &Config{}); code != 3 {
+		t.Fatalf("Expected exit code to be 3, got %d", code)
+	}
+
+	select {
+	case result := <-trailer:
+		if result != `{"exit_code":3}` {
+			t.Fatalf("Expected the Busl-Status trailer to hold the exit code, got %s", result)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("POST channel got no response")
+	}
+}
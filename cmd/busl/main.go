@@ -1,16 +1,22 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/heroku/busl/auth"
 	"github.com/heroku/busl/server"
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/util"
 	"github.com/heroku/rollbar"
 )
 
@@ -23,6 +29,21 @@ type cmdConfig struct {
 	HTTPWriteTimeout time.Duration
 }
 
+// patterns collects repeated -redactPattern flags.
+type patterns []*regexp.Regexp
+
+func (p *patterns) String() string {
+	return fmt.Sprint(*p)
+}
+
+func (p *patterns) Set(value string) error {
+	pattern, err := regexp.Compile(value)
+	if err == nil {
+		*p = append(*p, pattern)
+	}
+	return err
+}
+
 func main() {
 	fmt.Println("Starting busl...")
 	cmdConf, httpConf, err := parseFlags()
@@ -36,21 +57,31 @@ func main() {
 		rollbar.ServerRoot = "github.com/heroku/busl"
 	}
 
+	// Spans are exported as JSON lines to stdout or POSTed to a collector.
+	switch exporter := os.Getenv("TRACE_EXPORTER"); exporter {
+	case "":
+	case "stdout":
+		trace.SetExporter(trace.NewJSONExporter(os.Stdout))
+	default:
+		trace.SetExporter(trace.NewHTTPExporter(exporter))
+	}
+
 	_, err = strconv.Atoi(cmdConf.HTTPPort)
 	if err != nil {
-		log.Printf("%s: $PORT must be an integer value.\n", os.Args[0])
+		util.Error("$PORT must be an integer value", "cmd", os.Args[0])
 		os.Exit(1)
 	}
 
 	s := server.NewServer(httpConf)
 	s.ReadTimeout = cmdConf.HTTPReadTimeout
 	s.WriteTimeout = cmdConf.HTTPWriteTimeout
+	go reloadCredentials(s, syscall.SIGHUP)
 	s.Start(cmdConf.HTTPPort, awaitSignals(syscall.SIGURG))
 }
 
-func parseFlags() (*cmdConfig, *server.Config, error) {
-	httpConf := &server.Config{}
-	cmdConf := &cmdConfig{}
+func parseFlags() (cmdConf *cmdConfig, httpConf *server.Config, err error) {
+	httpConf = &server.Config{}
+	cmdConf = &cmdConfig{}
 
 	cmdConf.RollbarEnvironment = os.Getenv("ROLLBAR_ENVIRONMENT")
 	cmdConf.RollbarToken = os.Getenv("ROLLBAR_TOKEN")
@@ -59,26 +90,138 @@ func parseFlags() (*cmdConfig, *server.Config, error) {
 	flag.DurationVar(&cmdConf.HTTPReadTimeout, "httpReadTimeout", time.Hour, "Timeout for HTTP request reading")
 	flag.DurationVar(&cmdConf.HTTPWriteTimeout, "httpWriteTimeout", time.Hour, "Timeout for HTTP request writing")
 
+	util.LogCounts = os.Getenv("LOG_COUNTS") != "0"
+	if err = util.SetLogFormat(os.Getenv("LOG_FORMAT")); err != nil {
+		util.Error("$LOG_FORMAT", "cmd", os.Args[0], "error", err)
+		return nil, nil, err
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		lvl, err := util.ParseLevel(level)
+		if err != nil {
+			util.Error("$LOG_LEVEL", "cmd", os.Args[0], "error", err)
+			return nil, nil, err
+		}
+		util.SetLogLevel(lvl)
+	}
+
 	httpConf.Credentials = os.Getenv("CREDS")
+	httpConf.CredentialsFile = os.Getenv("CREDS_FILE")
+	httpConf.JWTSecret = os.Getenv("JWT_SECRET")
+	httpConf.JWTKeysFile = os.Getenv("JWT_KEYS_FILE")
+	httpConf.JWTAudience = os.Getenv("JWT_AUDIENCE")
+	httpConf.NamespacesFile = os.Getenv("NAMESPACES_FILE")
+	if scopes := os.Getenv("AUTHENTICATED_SCOPES"); scopes != "" {
+		if httpConf.AuthenticatedScopes, err = auth.ParseScopes(scopes); err != nil {
+			util.Error("$AUTHENTICATED_SCOPES", "cmd", os.Args[0], "error", err)
+			return nil, nil, err
+		}
+	}
 	httpConf.EnforceHTTPS = os.Getenv("ENFORCE_HTTPS") == "1"
+	httpConf.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	httpConf.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	httpConf.TLSClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	httpConf.StreamTokens = os.Getenv("STREAM_TOKENS") == "1"
+	httpConf.SigningKey = os.Getenv("SIGNING_KEY")
+	httpConf.CreateRateLimit, _ = strconv.Atoi(os.Getenv("CREATE_RATE_LIMIT"))
+	httpConf.MaxStreamSubscribers, _ = strconv.Atoi(os.Getenv("MAX_STREAM_SUBSCRIBERS"))
+	httpConf.MaxIPSubscribers, _ = strconv.Atoi(os.Getenv("MAX_IP_SUBSCRIBERS"))
+	httpConf.PublishRateLimit, _ = strconv.ParseInt(os.Getenv("PUBLISH_RATE_LIMIT"), 10, 64)
+	if httpConf.TrustedProxies, err = parseNetworks(splitList(os.Getenv("TRUSTED_PROXIES"))); err != nil {
+		util.Error("$TRUSTED_PROXIES", "cmd", os.Args[0], "error", err)
+		return nil, nil, err
+	}
+	httpConf.CORSOrigins = splitList(os.Getenv("CORS_ORIGINS"))
+	httpConf.CORSAllowHeaders = splitList(os.Getenv("CORS_ALLOW_HEADERS"))
+	httpConf.CORSExposeHeaders = splitList(os.Getenv("CORS_EXPOSE_HEADERS"))
+	flag.DurationVar(&httpConf.CORSMaxAge, "corsMaxAge", 10*time.Minute, "How long browsers may cache CORS preflight responses.")
 	flag.DurationVar(&httpConf.HeartbeatDuration, "subscribeHeartbeatDuration", time.Second*10, "Heartbeat interval for HTTP stream subscriptions.")
+	flag.DurationVar(&httpConf.LineFlushDuration, "subscribeLineFlushDuration", time.Second, "How long a partial line is held back for line oriented subscriptions.")
 	httpConf.StorageBaseURL = os.Getenv("STORAGE_BASE_URL")
+	httpConf.WebhookURLs = splitList(os.Getenv("WEBHOOK_URLS"))
+	httpConf.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	if len(httpConf.WebhookURLs) > 0 && httpConf.WebhookSecret == "" {
+		err = errors.New("required with $WEBHOOK_URLS")
+		util.Error("$WEBHOOK_SECRET", "cmd", os.Args[0], "error", err)
+		return nil, nil, err
+	}
+	if size := os.Getenv("SUBSCRIBER_BUFFER_BYTES"); size != "" {
+		if httpConf.SubscriberBuffer, err = strconv.Atoi(size); err != nil || httpConf.SubscriberBuffer <= 0 {
+			err = fmt.Errorf("invalid size %q", size)
+			util.Error("$SUBSCRIBER_BUFFER_BYTES", "cmd", os.Args[0], "error", err)
+			return nil, nil, err
+		}
+	}
+
+	httpConf.SlowSubscriberPolicy = os.Getenv("SLOW_SUBSCRIBER_POLICY")
+	switch httpConf.SlowSubscriberPolicy {
+	case "", "disconnect", "skip":
+	default:
+		err = fmt.Errorf("unknown policy %q", httpConf.SlowSubscriberPolicy)
+		util.Error("$SLOW_SUBSCRIBER_POLICY", "cmd", os.Args[0], "error", err)
+		return nil, nil, err
+	}
+	httpConf.RedactDefaults = os.Getenv("REDACT_DEFAULTS") == "1"
+	flag.Var((*patterns)(&httpConf.RedactPatterns), "redactPattern", "Regular expression masked out of published streams, may be repeated.")
 
 	flag.Parse()
 
 	return cmdConf, httpConf, nil
 }
 
+// Splits a comma separated list, returning nil for an empty one.
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseNetworks parses CIDR blocks, or single IPs.
+func parseNetworks(items []string) (networks []*net.IPNet, err error) {
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func awaitSignals(signals ...os.Signal) <-chan struct{} {
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, signals...)
-	log.Printf("signals.await signals=%v\n", signals)
+	util.Info("signals.await", "signals", fmt.Sprint(signals))
 
 	received := make(chan struct{})
 	go func() {
-		log.Printf("signals.received signal=%v\n", <-s)
+		util.Info("signals.received", "signal", fmt.Sprint(<-s))
 		close(received)
 	}()
 
 	return received
 }
+
+// Rereads the credentials file every time one of signals is received.
+func reloadCredentials(s *server.Server, signals ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+
+	for sig := range c {
+		if err := s.ReloadCredentials(); err != nil {
+			util.Error("credentials.reload", "signal", fmt.Sprint(sig), "error", err)
+			continue
+		}
+		util.Info("credentials.reload", "signal", fmt.Sprint(sig))
+	}
+}
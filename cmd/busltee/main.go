@@ -28,7 +28,10 @@ func main() {
 		rollbar.ServerRoot = "github.com/heroku/busl"
 	}
 
-	busltee.OpenLogs(publisherConf.LogFile, publisherConf.LogPrefix)
+	if err := busltee.OpenLogs(publisherConf.LogFile, publisherConf.LogPrefix, publisherConf.LogFormat, publisherConf.LogLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
 	defer busltee.CloseLogs()
 
 	if exitCode := busltee.Run(publisherConf.URL, publisherConf.Args, publisherConf); exitCode != 0 {
@@ -56,7 +59,10 @@ func parseFlags() (*cmdConfig, *busltee.Config, error) {
 	// Logging related flags
 	flag.StringVar(&publisherConf.LogPrefix, "log-prefix", "", "log prefix")
 	flag.StringVar(&publisherConf.LogFile, "log-file", "", "log file")
+	flag.StringVar(&publisherConf.LogFormat, "log-format", "logfmt", "log format, logfmt or json (which has no prefix)")
+	flag.StringVar(&publisherConf.LogLevel, "log-level", "info", "minimum log level: debug, info, warn or error")
 	flag.StringVar(&publisherConf.RequestID, "request-id", "", "request id")
+	flag.StringVar(&publisherConf.TraceParent, "traceparent", os.Getenv("TRACEPARENT"), "W3C traceparent to trace the upload under")
 
 	if flag.Parse(); len(flag.Args()) < 2 {
 		return nil, nil, errors.New("insufficient args")
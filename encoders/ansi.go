@@ -0,0 +1,290 @@
+package encoders
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+const esc = 0x1b
+
+// Escape sequences longer than this are treated as garbage
+// rather than held back waiting for their end.
+const maxEscape = 256
+
+// escapeLength returns the length of the escape sequence at the start
+// of p (p[0] being ESC), or -1 if p ends before the sequence does.
+//
+// Handled are CSI sequences (ESC [ params final), OSC sequences
+// (ESC ] ... terminated by BEL or ESC \), character set selections
+// (ESC ( X) and any other two byte ESC X sequence.
+func escapeLength(p []byte) int {
+	if len(p) < 2 {
+		return -1
+	}
+
+	switch p[1] {
+	case '[':
+		for i := 2; i < len(p); i++ {
+			if p[i] >= 0x40 && p[i] <= 0x7e {
+				return i + 1
+			}
+		}
+	case ']':
+		for i := 2; i < len(p); i++ {
+			if p[i] == 0x07 {
+				return i + 1
+			}
+			if p[i] == esc && i+1 < len(p) && p[i+1] == '\\' {
+				return i + 2
+			}
+		}
+	case '(', ')':
+		if len(p) >= 3 {
+			return 3
+		}
+	default:
+		return 2
+	}
+	return -1
+}
+
+// incompleteEscape returns the length of an escape sequence
+// cut short at the end of p, or 0 if p doesn't end with one.
+// p is expected to start outside of any escape sequence.
+func incompleteEscape(p []byte) int {
+	i := bytes.IndexByte(p, esc)
+	for i >= 0 {
+		n := escapeLength(p[i:])
+		if n < 0 {
+			if len(p)-i > maxEscape {
+				return 0
+			}
+			return len(p) - i
+		}
+
+		j := bytes.IndexByte(p[i+n:], esc)
+		if j < 0 {
+			break
+		}
+		i += n + j
+	}
+	return 0
+}
+
+// stripANSI removes escape sequences from p.
+func stripANSI(p []byte) []byte {
+	if bytes.IndexByte(p, esc) < 0 {
+		return p
+	}
+
+	buf := make([]byte, 0, len(p))
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, esc)
+		if i < 0 {
+			buf = append(buf, p...)
+			break
+		}
+		buf = append(buf, p[:i]...)
+
+		n := escapeLength(p[i:])
+		if n < 0 {
+			// Unterminated, e.g. too long to be held back: only
+			// the ESC goes, the rest is kept as text.
+			n = 1
+		}
+		p = p[i+n:]
+	}
+	return buf
+}
+
+// sgr is the graphic rendition state set by `ESC [ ... m`.
+type sgr struct {
+	bold, faint, italic, underline bool
+	fg, bg                         string // class suffix or css color
+}
+
+func (s *sgr) classes() (classes []string, style []string) {
+	for _, attr := range []struct {
+		set  bool
+		name string
+	}{
+		{s.bold, "ansi-bold"},
+		{s.faint, "ansi-faint"},
+		{s.italic, "ansi-italic"},
+		{s.underline, "ansi-underline"},
+	} {
+		if attr.set {
+			classes = append(classes, attr.name)
+		}
+	}
+
+	for _, color := range []struct {
+		val, class, prop string
+	}{
+		{s.fg, "ansi-fg-", "color"},
+		{s.bg, "ansi-bg-", "background-color"},
+	} {
+		switch {
+		case strings.HasPrefix(color.val, "#"):
+			style = append(style, color.prop+":"+color.val)
+		case color.val != "":
+			classes = append(classes, color.class+color.val)
+		}
+	}
+	return classes, style
+}
+
+var ansiColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// apply updates the state with the parameters of an SGR sequence.
+func (s *sgr) apply(params string) {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, _ := strconv.Atoi(codes[i])
+
+		switch {
+		case code == 0:
+			*s = sgr{}
+		case code == 1:
+			s.bold = true
+		case code == 2:
+			s.faint = true
+		case code == 3:
+			s.italic = true
+		case code == 4:
+			s.underline = true
+		case code == 22:
+			s.bold, s.faint = false, false
+		case code == 23:
+			s.italic = false
+		case code == 24:
+			s.underline = false
+		case code >= 30 && code <= 37:
+			s.fg = ansiColors[code-30]
+		case code >= 90 && code <= 97:
+			s.fg = "bright-" + ansiColors[code-90]
+		case code == 39:
+			s.fg = ""
+		case code >= 40 && code <= 47:
+			s.bg = ansiColors[code-40]
+		case code >= 100 && code <= 107:
+			s.bg = "bright-" + ansiColors[code-100]
+		case code == 49:
+			s.bg = ""
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			if code == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+			i += n
+		}
+	}
+}
+
+// extendedColor parses the `5;n` and `2;r;g;b` forms following 38 and
+// 48, returning a css color and the number of parameters consumed.
+func extendedColor(codes []string) (string, int) {
+	if len(codes) == 0 {
+		return "", 0
+	}
+
+	n := make([]int, len(codes))
+	for i, code := range codes {
+		n[i], _ = strconv.Atoi(code)
+	}
+
+	switch {
+	case n[0] == 5 && len(n) >= 2:
+		return xterm256(n[1]), 2
+	case n[0] == 2 && len(n) >= 4:
+		for _, c := range n[1:4] {
+			if c < 0 || c > 255 {
+				return "", 4
+			}
+		}
+		return fmt.Sprintf("#%02x%02x%02x", n[1], n[2], n[3]), 4
+	}
+	return "", 1
+}
+
+func xterm256(n int) string {
+	switch {
+	case n < 0:
+		return ""
+	case n < 8:
+		return ansiColors[n]
+	case n < 16:
+		return "bright-" + ansiColors[n-8]
+	case n < 232:
+		n -= 16
+		levels := []int{0, 95, 135, 175, 215, 255}
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[n/6%6], levels[n%6])
+	case n < 256:
+		gray := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+	return ""
+}
+
+// ansiHTML renders text with SGR escape sequences as HTML fragments.
+// The rendition state is kept across calls, so every fragment can be
+// appended to the previous ones as is.
+type ansiHTML struct {
+	state sgr
+}
+
+func (h *ansiHTML) convert(p []byte) []byte {
+	var buf bytes.Buffer
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, esc)
+		if i < 0 {
+			i = len(p)
+		}
+		h.text(&buf, p[:i])
+
+		if i == len(p) {
+			break
+		}
+
+		n := escapeLength(p[i:])
+		if n < 0 {
+			// Unterminated: only the ESC goes, as in stripANSI.
+			n = 1
+		}
+		if seq := p[i : i+n]; n > 2 && seq[1] == '[' && seq[n-1] == 'm' {
+			h.state.apply(string(seq[2 : n-1]))
+		}
+		p = p[i+n:]
+	}
+
+	return buf.Bytes()
+}
+
+func (h *ansiHTML) text(buf *bytes.Buffer, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	classes, style := h.state.classes()
+	if len(classes) == 0 && len(style) == 0 {
+		buf.WriteString(html.EscapeString(string(p)))
+		return
+	}
+
+	buf.WriteString("<span")
+	if len(classes) > 0 {
+		fmt.Fprintf(buf, ` class="%s"`, strings.Join(classes, " "))
+	}
+	if len(style) > 0 {
+		fmt.Fprintf(buf, ` style="%s"`, strings.Join(style, ";"))
+	}
+	buf.WriteString(">")
+	buf.WriteString(html.EscapeString(string(p)))
+	buf.WriteString("</span>")
+}
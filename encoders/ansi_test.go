@@ -0,0 +1,116 @@
+package encoders
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripANSI(t *testing.T) {
+	cases := map[string]string{
+		"plain":                            "plain",
+		"\x1b[1;31mred\x1b[0m":             "red",
+		"\x1b]0;title\x07text":             "text",
+		"\x1b]0;title\x1b\\text":           "text",
+		"\x1b(Bcharset":                    "charset",
+		"\x1b=keypad":                      "keypad",
+		"100%\x1b[K\r\x1b[2Kdone":          "100%\rdone",
+		"caf\xc3\xa9 \x1b[32m\xe2\x9c\x93": "caf\xc3\xa9 \xe2\x9c\x93",
+	}
+
+	for input, output := range cases {
+		assert.Equal(t, output, string(stripANSI([]byte(input))))
+	}
+}
+
+func TestIncompleteEscape(t *testing.T) {
+	cases := map[string]int{
+		"hello":              0,
+		"hello\x1b":          1,
+		"hello\x1b[":         2,
+		"hello\x1b[1;3":      5,
+		"hello\x1b[1;31m":    0,
+		"hello\x1b]0;ti":     6,
+		"hello\x1b]0;ti\x1b": 7,
+		"\x1b]0;t\x1b\\":     0,
+		"hello\x1b(":         2,
+	}
+
+	for input, n := range cases {
+		assert.Equal(t, n, incompleteEscape([]byte(input)), "%q", input)
+	}
+}
+
+func TestStripANSIAcrossReads(t *testing.T) {
+	r, w := io.Pipe()
+	enc := NewRawEncoder(r, Options{StripANSI: true})
+
+	go func() {
+		w.Write([]byte("hello \x1b[3"))
+		w.Write([]byte("1mworld\x1b"))
+		w.Write([]byte("[0m\n"))
+		w.Close()
+	}()
+
+	assert.Equal(t, "hello world\n", readstring(enc))
+}
+
+func TestStripANSIKeepsOffsets(t *testing.T) {
+	r := strings.NewReader("\x1b[31mhello\x1b[0m\n")
+	enc := NewSSEEncoderWithOptions(r, Options{Lines: true, StripANSI: true})
+
+	assert.Equal(t, "id: 15\ndata: hello\n\n", readstring(enc))
+
+	enc = NewNDJSONEncoderWithOptions(strings.NewReader("\x1b[31mhello\x1b[0m\n"), Options{StripANSI: true})
+	records := readrecords(enc)
+	assert.Equal(t, "hello\n", records[0]["data"])
+	assert.Equal(t, float64(15), records[0]["next"])
+}
+
+func TestUnterminatedEscape(t *testing.T) {
+	input := "before\x1b]" + strings.Repeat("x", 300) + "\nafter line 1\nafter line 2\n"
+	output := "before]" + strings.Repeat("x", 300) + "\nafter line 1\nafter line 2\n"
+
+	enc := NewRawEncoder(strings.NewReader(input), Options{StripANSI: true})
+	assert.Equal(t, output, readstring(enc))
+
+	enc = NewHTMLEncoder(strings.NewReader(input), Options{})
+	assert.Equal(t, output, readstring(enc))
+}
+
+func TestHTML(t *testing.T) {
+	cases := map[string]string{
+		"a < b":                       "a &lt; b",
+		"\x1b[1;31mfail\x1b[0m ok":    `<span class="ansi-bold ansi-fg-red">fail</span> ok`,
+		"\x1b[92;44mhi\x1b[39mthere":  `<span class="ansi-fg-bright-green ansi-bg-blue">hi</span><span class="ansi-bg-blue">there</span>`,
+		"\x1b[38;5;208morange":        `<span style="color:#ff8700">orange</span>`,
+		"\x1b[48;2;1;2;3m\x1b[4mrgb":  `<span class="ansi-underline" style="background-color:#010203">rgb</span>`,
+		"\x1b]0;title\x07\x1b[Kplain": "plain",
+		"\x1b[38;5;-1mnone":           "none",
+		"\x1b[38;5;256mnone":          "none",
+		"\x1b[48;2;-1;0;256mnone":     "none",
+	}
+
+	for input, output := range cases {
+		enc := NewHTMLEncoder(strings.NewReader(input), Options{})
+		assert.Equal(t, output, readstring(enc), "%q", input)
+	}
+}
+
+func TestHTMLAcrossReads(t *testing.T) {
+	r, w := io.Pipe()
+	enc := NewHTMLEncoder(r, Options{})
+
+	go func() {
+		w.Write([]byte("\x1b[3"))
+		w.Write([]byte("2mgreen\n"))
+		w.Write([]byte("still green\x1b[0m done"))
+		w.Close()
+	}()
+
+	expected := `<span class="ansi-fg-green">green` + "\n" + `</span>` +
+		`<span class="ansi-fg-green">still green</span> done`
+	assert.Equal(t, expected, readstring(enc))
+}
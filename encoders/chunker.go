@@ -0,0 +1,196 @@
+package encoders
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// readSize is how much is read from the underlying reader at once,
+// independently of the size of the buffers handed to the encoders.
+const readSize = 32 * 1024
+
+// maxLine is how much of a partial line is held back at most: longer
+// lines are split, whether or not partial lines are ever flushed.
+const maxLine = 64 * 1024
+
+// chunk is a run of bytes read from the underlying reader
+// together with the offset of its first byte.
+type chunk struct {
+	offset int64
+	data   []byte
+	time   time.Time // when the first byte was written, if known
+}
+
+// end returns the offset right after the chunk, which is
+// where a client resuming after this chunk should continue.
+func (c *chunk) end() int64 {
+	return c.offset + int64(len(c.data))
+}
+
+type payload struct {
+	p   []byte
+	err error
+}
+
+// chunker reads from the underlying reader while keeping track of
+// offsets. In line mode every chunk is a single complete line: a
+// trailing partial line is held back until its newline arrives, the
+// reader is exhausted, no data arrived for the flush duration or it
+// grew to maxLine.
+type chunker struct {
+	reader  io.Reader     // stores the original reader
+	offset  int64         // offset of the next byte to be handed out
+	lines   bool          // whether chunks are split on newlines
+	flush   time.Duration // how long a partial line is held back
+	escapes bool          // whether partial escape sequences are held back
+	held    []byte        // partial line waiting for its newline
+	rerr    error         // sticky error from the original reader
+	ch      chan *payload // background reads in line mode
+	done    chan struct{} // closed to stop the background reads
+	once    sync.Once
+}
+
+func newChunker(r io.Reader, opts Options) *chunker {
+	return &chunker{
+		reader:  r,
+		lines:   opts.Lines,
+		flush:   opts.Flush,
+		escapes: opts.StripANSI,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *chunker) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := c.reader.(io.ReadSeeker); ok {
+		c.offset, err = seeker.Seek(offset, whence)
+	} else {
+		// The underlying reader doesn't support seeking, but
+		// we should still update the offset so the IDs will
+		// properly reflect the adjusted offset.
+		c.offset += offset
+	}
+
+	return c.offset, err
+}
+
+func (c *chunker) Close() error {
+	c.once.Do(func() { close(c.done) })
+
+	if closer, ok := c.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// next returns the next chunk read (or the next line in line
+// mode) along with any error from the underlying reader.
+func (c *chunker) next() (*chunk, error) {
+	if c.lines {
+		return c.nextLine()
+	}
+
+	p := make([]byte, readSize)
+	n, err := c.reader.Read(p)
+	if !c.escapes {
+		return c.take(p[:n]), err
+	}
+
+	c.held = append(c.held, p[:n]...)
+	if err != nil {
+		return c.takeHeld(len(c.held)), err
+	}
+	return c.takeHeld(len(c.held) - incompleteEscape(c.held)), nil
+}
+
+func (c *chunker) nextLine() (*chunk, error) {
+	if c.ch == nil {
+		c.ch = make(chan *payload)
+		go c.readLoop()
+	}
+
+	for {
+		if i := bytes.IndexByte(c.held, '\n'); i >= 0 {
+			return c.takeHeld(i + 1), nil
+		}
+
+		if c.rerr != nil {
+			return c.takeHeld(len(c.held)), c.rerr
+		}
+
+		if len(c.held) >= maxLine {
+			return c.takeHeld(len(c.held) - c.partialEscape()), nil
+		}
+
+		payload, ok := c.wait()
+		if !ok {
+			return c.takeHeld(len(c.held) - c.partialEscape()), nil
+		}
+		c.held = append(c.held, payload.p...)
+		c.rerr = payload.err
+	}
+}
+
+// wait blocks for the next background read, giving up after the
+// flush duration when a partial line is being held back.
+func (c *chunker) wait() (*payload, bool) {
+	var timeout <-chan time.Time
+	if len(c.held) > 0 && c.flush > 0 {
+		timer := time.NewTimer(c.flush)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case payload := <-c.ch:
+		return payload, true
+	case <-c.done:
+		return &payload{err: io.EOF}, true
+	case <-timeout:
+		return nil, false
+	}
+}
+
+func (c *chunker) readLoop() {
+	for {
+		payload := &payload{p: make([]byte, readSize)}
+		n, err := c.reader.Read(payload.p)
+		payload.p, payload.err = payload.p[:n], err
+
+		select {
+		case c.ch <- payload:
+		case <-c.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// partialEscape returns how many bytes at the end of the held
+// data make up an incomplete escape sequence to keep holding.
+func (c *chunker) partialEscape() int {
+	if !c.escapes {
+		return 0
+	}
+	return incompleteEscape(c.held)
+}
+
+func (c *chunker) takeHeld(n int) *chunk {
+	chunk := c.take(c.held[:n:n])
+	c.held = c.held[n:]
+	return chunk
+}
+
+func (c *chunker) take(p []byte) *chunk {
+	chunk := &chunk{offset: c.offset, data: p}
+	c.offset += int64(len(p))
+
+	if ts, ok := c.reader.(Timestamper); ok && len(p) > 0 {
+		chunk.time, _ = ts.Timestamp(chunk.offset)
+	}
+	return chunk
+}
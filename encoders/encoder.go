@@ -0,0 +1,118 @@
+package encoders
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// Encoder transforms the stream read from an underlying reader. Seek
+// positions both the underlying reader (if possible) and the offsets
+// reported by the encoder; Close closes the underlying reader. Offset
+// is the offset in the stream right after what was read from the
+// encoder, not counting frames which were only partly read, and
+// Buffered the size of what's left of those frames. Gap frames a
+// marker telling that the stream from offset from to offset to was
+// skipped, or is nil if the encoding has none.
+type Encoder interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+	Offset() int64
+	Buffered() int
+	Gap(from, to int64) []byte
+}
+
+// Options tweak how encoders split and annotate the stream.
+type Options struct {
+	Lines      bool          // one event or record per line
+	Flush      time.Duration // how long partial lines are held back, forever if 0
+	Timestamps bool          // annotate SSE events with write times
+	StripANSI  bool          // remove ANSI escape sequences from the data
+}
+
+// Stater is implemented by readers which know the state of the
+// stream they read, e.g. whether it's still being written to.
+type Stater interface {
+	State() string
+}
+
+// Timestamper is implemented by readers which know when
+// the bytes they read were originally written.
+type Timestamper interface {
+	Timestamp(offset int64) (time.Time, bool)
+}
+
+// encoder frames the chunks read by its chunker. Framed output
+// which doesn't fit in the buffer handed to Read is kept around
+// and handed out on subsequent reads.
+type encoder struct {
+	*chunker
+	opts  Options
+	frame func(c *chunk, err error) []byte
+	gap   func(from, to int64) []byte
+	buf   bytes.Buffer // framed output not yet handed out
+	err   error        // returned once buf is drained
+	end   int64        // offset right after the chunks framed into buf
+	read  int64        // offset right after the chunks entirely handed out
+	held  int64        // bytes of the last chunk frame held back for the next one
+}
+
+func (e *encoder) Read(p []byte) (n int, err error) {
+	for e.buf.Len() == 0 && e.err == nil {
+		chunk, err := e.next()
+		e.buf.Write(e.frame(chunk, err))
+		e.err = err
+		e.end = chunk.end() - e.held
+	}
+
+	n, _ = e.buf.Read(p)
+	if e.buf.Len() == 0 {
+		err = e.err
+		e.read = e.end
+	}
+
+	return n, err
+}
+
+func (e *encoder) Seek(offset int64, whence int) (int64, error) {
+	n, err := e.chunker.Seek(offset, whence)
+	e.end, e.read = n, n
+	return n, err
+}
+
+func (e *encoder) Offset() int64 {
+	return e.read
+}
+
+func (e *encoder) Buffered() int {
+	return e.buf.Len()
+}
+
+func (e *encoder) Gap(from, to int64) []byte {
+	if e.gap == nil {
+		return nil
+	}
+	return e.gap(from, to)
+}
+
+// transform applies the data transforms enabled by the options.
+func (e *encoder) transform(p []byte) []byte {
+	if e.opts.StripANSI {
+		return stripANSI(p)
+	}
+	return p
+}
+
+// state returns the state of the stream as reported by the
+// underlying reader, if it knows about it.
+func (e *encoder) state() string {
+	if stater, ok := e.reader.(Stater); ok {
+		return stater.State()
+	}
+	return ""
+}
+
+func newEncoder(r io.Reader, opts Options) *encoder {
+	return &encoder{chunker: newChunker(r, opts), opts: opts}
+}
@@ -0,0 +1,28 @@
+package encoders
+
+import (
+	"fmt"
+	"io"
+)
+
+// NewHTMLEncoder creates an encoder rendering the stream read from r
+// as HTML fragments. Text is escaped and ANSI colors and attributes
+// are turned into spans with `ansi-*` classes (e.g. `ansi-bold` or
+// `ansi-fg-red`), or inline styles for 256 and true colors. Other
+// escape sequences are dropped.
+//
+// Every fragment carries the rendition state of the stream so far,
+// so fragments can simply be appended to each other. Reading from an
+// offset starts with the default rendition, whatever came before it.
+// Skipped parts of the stream are marked by an empty `busl-gap` span.
+func NewHTMLEncoder(r io.Reader, opts Options) Encoder {
+	e := newEncoder(r, opts)
+	e.escapes = true
+
+	converter := &ansiHTML{}
+	e.frame = func(c *chunk, _ error) []byte { return converter.convert(c.data) }
+	e.gap = func(from, to int64) []byte {
+		return []byte(fmt.Sprintf(`<span class="busl-gap" data-offset="%d" data-next="%d"></span>`, from, to))
+	}
+	return e
+}
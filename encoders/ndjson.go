@@ -0,0 +1,141 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// record is a single NDJSON line. Offset is the position of the first
+// byte of data in the stream, Next the position right after it (i.e.
+// where to resume from using Last-Event-ID or Range).
+type record struct {
+	Offset   int64  `json:"offset"`
+	Next     int64  `json:"next"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
+	Time     string `json:"time"`
+	State    string `json:"state,omitempty"`
+}
+
+// doneRecord terminates a stream which was read until the end.
+type doneRecord struct {
+	Done   bool  `json:"done"`
+	Offset int64 `json:"offset"`
+}
+
+// gapRecord tells that the stream from Offset to Next was skipped.
+type gapRecord struct {
+	Gap    bool  `json:"gap"`
+	Offset int64 `json:"offset"`
+	Next   int64 `json:"next"`
+}
+
+type ndjsonEncoder struct {
+	*encoder
+	pending []byte // incomplete UTF-8 sequence held for the next chunk
+}
+
+// NewNDJSONEncoder creates a new newline delimited JSON encoder
+// emitting one record per read from r.
+//
+// Data is emitted as a string if it's valid UTF-8, and base64 encoded
+// otherwise (with `"encoding":"base64"`). The time of a record is when
+// its first byte was written if r knows about it, and when it was
+// read otherwise. A final `{"done":true}` record is emitted once the
+// stream has been read until the end.
+func NewNDJSONEncoder(r io.Reader) Encoder {
+	return NewNDJSONEncoderWithOptions(r, Options{})
+}
+
+// NewNDJSONEncoderWithOptions creates a new newline delimited JSON
+// encoder. With Lines, one record is emitted per line read from r,
+// with the trailing newline stripped from the data. Partial lines are
+// held back until their newline arrives or nothing was read for the
+// Flush duration. With StripANSI, escape sequences are removed from
+// the data; offsets keep referring to the original stream.
+func NewNDJSONEncoderWithOptions(r io.Reader, opts Options) Encoder {
+	e := &ndjsonEncoder{encoder: newEncoder(r, opts)}
+	e.frame = e.format
+	e.gap = func(from, to int64) []byte {
+		var buf bytes.Buffer
+		writeJSON(&buf, &gapRecord{Gap: true, Offset: from, Next: to})
+		return buf.Bytes()
+	}
+	return e
+}
+
+func (e *ndjsonEncoder) format(c *chunk, err error) []byte {
+	var buf bytes.Buffer
+
+	// Keep multi-byte characters split across chunks
+	// together so they don't force base64 encoding.
+	data := append(e.pending, c.data...)
+	offset := c.offset - int64(len(e.pending))
+	e.pending = nil
+
+	if err == nil {
+		if n := incompleteRune(data); n > 0 {
+			e.pending = append([]byte{}, data[len(data)-n:]...)
+			data = data[:len(data)-n]
+		}
+	}
+	e.held = int64(len(e.pending))
+
+	if len(data) > 0 {
+		ts := c.time
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+
+		rec := &record{
+			Offset: offset,
+			Next:   offset + int64(len(data)),
+			Time:   ts.UTC().Format(time.RFC3339Nano),
+			State:  e.state(),
+		}
+
+		if e.opts.Lines {
+			data = bytes.TrimSuffix(data, []byte{'\n'})
+		}
+		data = e.transform(data)
+
+		if utf8.Valid(data) {
+			rec.Data = string(data)
+		} else {
+			rec.Data = base64.StdEncoding.EncodeToString(data)
+			rec.Encoding = "base64"
+		}
+		writeJSON(&buf, rec)
+	}
+
+	if err == io.EOF {
+		writeJSON(&buf, &doneRecord{Done: true, Offset: c.end()})
+	}
+
+	return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, _ := json.Marshal(v)
+	buf.Write(b)
+	buf.WriteByte('\n')
+}
+
+// incompleteRune returns the length of a multi-byte UTF-8 sequence
+// cut short at the end of p, or 0 if p doesn't end with one.
+func incompleteRune(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		b := p[len(p)-i]
+		if utf8.RuneStart(b) {
+			if b >= utf8.RuneSelf && !utf8.FullRune(p[len(p)-i:]) {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
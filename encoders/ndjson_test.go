@@ -0,0 +1,113 @@
+package encoders
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNDJSON(t *testing.T) {
+	r := strings.NewReader("hello\nworld\n")
+	enc := NewNDJSONEncoder(r)
+	enc.Seek(6, 0)
+
+	records := readrecords(enc)
+	assert.Len(t, records, 2)
+
+	assert.Equal(t, float64(6), records[0]["offset"])
+	assert.Equal(t, float64(12), records[0]["next"])
+	assert.Equal(t, "world\n", records[0]["data"])
+	assert.Nil(t, records[0]["encoding"])
+	assert.NotEmpty(t, records[0]["time"])
+
+	assert.Equal(t, true, records[1]["done"])
+	assert.Equal(t, float64(12), records[1]["offset"])
+}
+
+func TestNDJSONGap(t *testing.T) {
+	enc := NewNDJSONEncoder(strings.NewReader("hello"))
+	assert.Equal(t, "{\"gap\":true,\"offset\":5,\"next\":9}\n", string(enc.Gap(5, 9)))
+}
+
+func TestNDJSONBinary(t *testing.T) {
+	r := strings.NewReader("\x1f\x8b\x08\x00")
+	records := readrecords(NewNDJSONEncoder(r))
+
+	assert.Equal(t, "H4sIAA==", records[0]["data"])
+	assert.Equal(t, "base64", records[0]["encoding"])
+}
+
+func TestNDJSONSplitRune(t *testing.T) {
+	r, w := io.Pipe()
+	enc := NewNDJSONEncoder(r)
+
+	go func() {
+		w.Write([]byte("caf\xc3"))
+		w.Write([]byte("\xa9!"))
+		w.Close()
+	}()
+
+	records := readrecords(enc)
+	assert.Len(t, records, 3)
+	assert.Equal(t, "caf", records[0]["data"])
+	assert.Equal(t, float64(3), records[0]["next"])
+	assert.Equal(t, "é!", records[1]["data"])
+	assert.Equal(t, float64(3), records[1]["offset"])
+	assert.Equal(t, float64(6), records[1]["next"])
+}
+
+func TestNDJSONSplitRuneOffset(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	enc := NewNDJSONEncoder(r)
+
+	go w.Write([]byte("caf\xc3"))
+
+	buf := make([]byte, 1024)
+	n, _ := enc.Read(buf)
+	assert.Contains(t, string(buf[:n]), `"data":"caf"`)
+
+	// Resuming from there starts with the whole character.
+	assert.Equal(t, int64(3), enc.Offset())
+}
+
+func TestNDJSONLines(t *testing.T) {
+	r := strings.NewReader("hello\nworld")
+	records := readrecords(NewNDJSONEncoderWithOptions(r, Options{Lines: true}))
+
+	assert.Len(t, records, 3)
+	assert.Equal(t, "hello", records[0]["data"])
+	assert.Equal(t, float64(6), records[0]["next"])
+	assert.Equal(t, "world", records[1]["data"])
+	assert.Equal(t, float64(11), records[1]["next"])
+	assert.Equal(t, true, records[2]["done"])
+}
+
+type stateReader struct {
+	io.Reader
+}
+
+func (s *stateReader) State() string {
+	return "archived"
+}
+
+func TestNDJSONState(t *testing.T) {
+	r := &stateReader{strings.NewReader("hello")}
+	records := readrecords(NewNDJSONEncoder(r))
+
+	assert.Equal(t, "archived", records[0]["state"])
+}
+
+func readrecords(r io.Reader) (records []map[string]interface{}) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &record)
+		records = append(records, record)
+	}
+	return records
+}
@@ -0,0 +1,12 @@
+package encoders
+
+import "io"
+
+// NewRawEncoder creates an encoder passing the stream read from r
+// through as is, except for the transforms enabled by opts (e.g.
+// StripANSI). Offsets keep referring to the original stream.
+func NewRawEncoder(r io.Reader, opts Options) Encoder {
+	e := newEncoder(r, opts)
+	e.frame = func(c *chunk, _ error) []byte { return e.transform(c.data) }
+	return e
+}
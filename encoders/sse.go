@@ -4,53 +4,73 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"time"
 )
 
 const (
-	id   = "id: %d\n"
-	data = "data: %s\n"
+	event     = "event: %s\n"
+	id        = "id: %d\n"
+	timestamp = "time: %s\n"
+	data      = "data: %s\n"
 )
 
-type sseEncoder struct {
-	reader io.Reader // stores the original reader
-	offset int64     // offset for Seek purposes
+// NewSSEEncoder creates a new server-sent event encoder
+// emitting one event per read from r.
+//
+// The `id` of every event is the offset right after its data, so
+// it can be used as a Last-Event-ID to resume the stream exactly.
+func NewSSEEncoder(r io.Reader) Encoder {
+	return NewSSEEncoderWithOptions(r, Options{})
 }
 
-// NewSSEEncoder creates a new server-sent event encoder
-func NewSSEEncoder(r io.Reader) io.Reader {
-	return &sseEncoder{reader: r}
+// NewSSEEncoderWithOptions creates a new server-sent event encoder.
+//
+// With Lines, one event is emitted per line read from r. Partial
+// lines are held back until their newline arrives or nothing was
+// read for the Flush duration. With Timestamps, every event gets a
+// `time` field holding when its first byte was written. With
+// StripANSI, escape sequences are removed from the data while ids
+// keep referring to offsets in the original stream.
+func NewSSEEncoderWithOptions(r io.Reader, opts Options) Encoder {
+	e := newEncoder(r, opts)
+	e.frame = e.sse
+	e.gap = sseGap
+	return e
 }
 
-func (r *sseEncoder) Seek(offset int64, whence int) (n int64, err error) {
-	if seeker, ok := r.reader.(io.ReadSeeker); ok {
-		r.offset, err = seeker.Seek(offset, whence)
-	} else {
-		// The underlying reader doesn't support seeking, but
-		// we should still update the offset so the IDs will
-		// properly reflect the adjusted offset.
-		r.offset += offset
+func (e *encoder) sse(c *chunk, _ error) []byte {
+	if len(c.data) == 0 {
+		return nil
 	}
 
-	return r.offset, err
-}
-
-// FIXME: this version is simplified and assumes
-// that len(p) is always greater than the potential
-// length of data to be read.
-func (r *sseEncoder) Read(p []byte) (n int, err error) {
-	n, err = r.reader.Read(p)
+	buf := bytes.NewBufferString(fmt.Sprintf(id, c.end()))
+	if e.opts.Timestamps && !c.time.IsZero() {
+		buf.WriteString(fmt.Sprintf(timestamp, c.time.Format(time.RFC3339Nano)))
+	}
 
-	if n > 0 {
-		buf := format(r.offset, p[:n])
-		r.offset += int64(n)
-		n = copy(p, buf)
+	msg := c.data
+	if e.opts.Lines {
+		msg = bytes.TrimSuffix(msg, []byte{'\n'})
 	}
+	buf.Write(format(e.transform(msg)))
+
+	return buf.Bytes()
+}
+
+// SSEEvent frames data as a server-sent event of the given type.
+// It has no id, so it doesn't move the client's Last-Event-ID.
+func SSEEvent(name string, data []byte) []byte {
+	return append([]byte(fmt.Sprintf(event, name)), format(data)...)
+}
 
-	return n, err
+// Skipped parts of the stream are told by an `event: gap`, whose id
+// is where the stream resumes.
+func sseGap(from, to int64) []byte {
+	return append([]byte(fmt.Sprintf(id, to)), SSEEvent("gap", []byte(fmt.Sprintf(`{"offset":%d,"next":%d}`, from, to)))...)
 }
 
-func format(pos int64, msg []byte) []byte {
-	buf := bytes.NewBufferString(fmt.Sprintf(id, pos+int64(len(msg))))
+func format(msg []byte) []byte {
+	var buf bytes.Buffer
 
 	for _, line := range bytes.Split(msg, []byte{'\n'}) {
 		buf.WriteString(fmt.Sprintf(data, line))
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -55,7 +56,142 @@ func TestNonSeekableReader(t *testing.T) {
 	assert.Equal(t, "id: 11\ndata: d\n\n", readstring(enc))
 }
 
+func TestSmallBuffer(t *testing.T) {
+	for _, data := range testdata {
+		r := strings.NewReader(data.input)
+		enc := NewSSEEncoder(r)
+		enc.Seek(data.offset, 0)
+
+		// Events are larger than the buffer, so they
+		// need to be handed out across several reads.
+		var out []byte
+		p := make([]byte, 3)
+		for {
+			n, err := enc.Read(p)
+			out = append(out, p[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		assert.Equal(t, data.output, string(out))
+	}
+}
+
+func TestLines(t *testing.T) {
+	data := []table{
+		{0, "hello", "id: 5\ndata: hello\n\n"},
+		{0, "hello\n", "id: 6\ndata: hello\n\n"},
+		{0, "hello\nworld", "id: 6\ndata: hello\n\nid: 11\ndata: world\n\n"},
+		{0, "hello\n\nworld\n", "id: 6\ndata: hello\n\nid: 7\ndata: \n\nid: 13\ndata: world\n\n"},
+		{6, "hello\nworld\n", "id: 12\ndata: world\n\n"},
+		{12, "hello\nworld\n", ""},
+	}
+
+	for _, data := range data {
+		r := strings.NewReader(data.input)
+		enc := NewSSEEncoderWithOptions(r, Options{Lines: true})
+		enc.Seek(data.offset, 0)
+		assert.Equal(t, data.output, readstring(enc))
+	}
+}
+
+func TestLinesAcrossReads(t *testing.T) {
+	r, w := io.Pipe()
+	enc := NewSSEEncoderWithOptions(r, Options{Lines: true})
+
+	go func() {
+		w.Write([]byte("hel"))
+		w.Write([]byte("lo\nwo"))
+		w.Write([]byte("rld\n"))
+		w.Close()
+	}()
+
+	assert.Equal(t, "id: 6\ndata: hello\n\nid: 12\ndata: world\n\n", readstring(enc))
+}
+
+func TestLinesFlush(t *testing.T) {
+	r, w := io.Pipe()
+	enc := NewSSEEncoderWithOptions(r, Options{Lines: true, Flush: 10 * time.Millisecond})
+	defer enc.Close()
+
+	go w.Write([]byte("hel"))
+
+	// The partial line gets flushed as is after the timeout.
+	p := make([]byte, 100)
+	n, err := enc.Read(p)
+	assert.Nil(t, err)
+	assert.Equal(t, "id: 3\ndata: hel\n\n", string(p[:n]))
+
+	go w.Write([]byte("lo\n"))
+
+	n, err = enc.Read(p)
+	assert.Nil(t, err)
+	assert.Equal(t, "id: 6\ndata: lo\n\n", string(p[:n]))
+}
+
+func TestLinesTooLong(t *testing.T) {
+	r, w := io.Pipe()
+	enc := NewSSEEncoderWithOptions(r, Options{Lines: true})
+	defer enc.Close()
+
+	// Without a flush duration, long partial lines are still split.
+	go w.Write([]byte(strings.Repeat("a", maxLine+1)))
+
+	p := make([]byte, 2*maxLine)
+	n, err := enc.Read(p)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(p[:n]), "id: 65536\n"))
+}
+
+type timedReader struct {
+	io.Reader
+}
+
+func (r *timedReader) Timestamp(offset int64) (time.Time, bool) {
+	return time.Date(2016, 9, 7, 10, 0, 0, int(offset), time.UTC), true
+}
+
+func TestTimestamps(t *testing.T) {
+	r := &timedReader{strings.NewReader("hello\nworld\n")}
+	enc := NewSSEEncoderWithOptions(r, Options{Lines: true, Timestamps: true})
+
+	expected := "id: 6\ntime: 2016-09-07T10:00:00Z\ndata: hello\n\n" +
+		"id: 12\ntime: 2016-09-07T10:00:00.000000006Z\ndata: world\n\n"
+	assert.Equal(t, expected, readstring(enc))
+
+	// Timestamps are only emitted when asked for.
+	r = &timedReader{strings.NewReader("hello")}
+	assert.Equal(t, "id: 5\ndata: hello\n\n", readstring(NewSSEEncoder(r)))
+}
+
 func readstring(r io.Reader) string {
 	buf, _ := ioutil.ReadAll(r)
 	return string(buf)
 }
+
+func TestSSEEvent(t *testing.T) {
+	assert.Equal(t, "event: status\ndata: {\"state\":\"success\"}\n\n", string(SSEEvent("status", []byte(`{"state":"success"}`))))
+}
+
+func TestOffset(t *testing.T) {
+	r := NewSSEEncoder(strings.NewReader("hello"))
+	r.Seek(1, 0)
+	assert.Equal(t, int64(1), r.Offset())
+
+	// Only frames read entirely count.
+	p := make([]byte, 4)
+	r.Read(p)
+	assert.Equal(t, int64(1), r.Offset())
+	assert.Equal(t, len("id: 5\ndata: ello\n\n")-4, r.Buffered())
+
+	ioutil.ReadAll(r)
+	assert.Equal(t, int64(5), r.Offset())
+}
+
+func TestGap(t *testing.T) {
+	r := NewSSEEncoder(strings.NewReader("hello"))
+	assert.Equal(t, "id: 9\nevent: gap\ndata: {\"offset\":5,\"next\":9}\n\n", string(r.Gap(5, 9)))
+
+	// Raw streams have no room for markers.
+	assert.Nil(t, NewRawEncoder(strings.NewReader("hello"), Options{}).Gap(5, 9))
+}
@@ -0,0 +1,295 @@
+// Package metrics keeps counters, gauges and histograms in process
+// and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds, from a millisecond to 10s.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics. It is safe for concurrent use.
+type Registry struct {
+	sync.Mutex
+	families []*family
+}
+
+// DefaultRegistry holds the metrics created by NewCounter,
+// NewGauge and NewHistogram.
+var DefaultRegistry = &Registry{}
+
+type family struct {
+	sync.Mutex
+	name, help, kind string
+	labels           []string
+	buckets          []float64 // upper bounds, histograms only
+	series           map[string]*series
+}
+
+type series struct {
+	labels string // `{a="b",...}` or ""
+	value  float64
+	counts []uint64 // cumulative per bucket, histograms only
+	count  uint64
+}
+
+func (r *Registry) register(f *family) *family {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, existing := range r.families {
+		if existing.name == f.name {
+			panic("metrics: " + f.name + " registered twice")
+		}
+	}
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	return f
+}
+
+// get returns the series for the label values, creating it if needed.
+// The family must be locked.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: formatLabels(f.labels, values)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) add(v float64, values []string) {
+	f.Lock()
+	f.get(values).value += v
+	f.Unlock()
+}
+
+func (f *family) set(v float64, values []string) {
+	f.Lock()
+	f.get(values).value = v
+	f.Unlock()
+}
+
+// Counter is a value which only goes up, e.g. requests served.
+type Counter struct {
+	f *family
+}
+
+// NewCounter creates a counter in the DefaultRegistry, with a
+// series per combination of the given labels' values.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return DefaultRegistry.NewCounter(name, help, labels...)
+}
+
+// NewCounter creates a counter in the registry.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc(values ...string) {
+	c.f.add(1, values)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counters can't decrease")
+	}
+	c.f.add(v, values)
+}
+
+// Gauge is a value which goes up and down, e.g. open connections.
+type Gauge struct {
+	f *family
+}
+
+// NewGauge creates a gauge in the DefaultRegistry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help, labels...)
+}
+
+// NewGauge creates a gauge in the registry.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc(values ...string) {
+	g.f.add(1, values)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec(values ...string) {
+	g.f.add(-1, values)
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.set(v, values)
+}
+
+// Histogram counts observations, e.g. latencies, in buckets.
+type Histogram struct {
+	f *family
+}
+
+// NewHistogram creates a histogram with the DefaultBuckets
+// in the DefaultRegistry.
+func NewHistogram(name, help string, labels ...string) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, DefaultBuckets, labels...)
+}
+
+// NewHistogram creates a histogram with the given bucket
+// upper bounds, in increasing order, in the registry.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(&family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.Lock()
+	defer h.f.Unlock()
+
+	s := h.f.get(values)
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.value += v
+	s.count++
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	families := append([]*family{}, r.families...)
+	r.Unlock()
+
+	sort.Sort(byName(families))
+
+	cw := &countingWriter{w: w}
+	for _, f := range families {
+		f.writeTo(cw)
+	}
+	return cw.n, cw.err
+}
+
+func (f *family) writeTo(w io.Writer) {
+	f.Lock()
+	defer f.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, s.labels, formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, s.labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, s.labels, s.count)
+	}
+}
+
+// Handler serves the DefaultRegistry's metrics.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// ServeHTTP serves the registry's metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type byName []*family
+
+func (f byName) Len() int           { return len(f) }
+func (f byName) Less(i, j int) bool { return f[i].name < f[j].name }
+func (f byName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escape(values[i], true) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to formatted labels.
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
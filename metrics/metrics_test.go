@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	r := &Registry{}
+	c := r.NewCounter("requests_total", "Requests served.", "code")
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc("5\"x\\")
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	assert.Equal(t, `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="5\"x\\"} 1
+`, buf.String())
+
+	assert.Panics(t, func() { c.Add(-1, "200") })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { r.NewCounter("requests_total", "again") })
+}
+
+func TestGauge(t *testing.T) {
+	r := &Registry{}
+	g := r.NewGauge("connections", "Open connections.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	assert.Contains(t, buf.String(), "# TYPE connections gauge\nconnections 1\n")
+
+	g.Set(1.5)
+	buf.Reset()
+	r.WriteTo(&buf)
+	assert.Contains(t, buf.String(), "connections 1.5\n")
+}
+
+func TestHistogram(t *testing.T) {
+	r := &Registry{}
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{.1, 1}, "op")
+	h.Observe(.05, "get")
+	h.Observe(.5, "get")
+	h.Observe(5, "get")
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="get",le="0.1"} 1
+latency_seconds_bucket{op="get",le="1"} 2
+latency_seconds_bucket{op="get",le="+Inf"} 3
+latency_seconds_sum{op="get"} 5.55
+latency_seconds_count{op="get"} 3
+`, buf.String())
+}
+
+func TestHandler(t *testing.T) {
+	r := &Registry{}
+	r.NewCounter("b_total", "B.").Inc()
+	r.NewCounter("a_total", "A.").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, &http.Request{})
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP a_total A.
+# TYPE a_total counter
+a_total 1
+# HELP b_total B.
+# TYPE b_total counter
+b_total 1
+`, w.Body.String())
+}
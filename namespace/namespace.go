@@ -0,0 +1,142 @@
+// Package namespace splits the keyspace between tenants, each
+// owning the keys which start with its prefix.
+package namespace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/auth"
+)
+
+// Duration is a time.Duration read from JSON strings such as "2h".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(buf []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// Namespace holds the settings of the keys starting with Prefix.
+type Namespace struct {
+	Prefix         string          `json:"prefix"`
+	Credentials    json.RawMessage `json:"credentials"`      // as a string or array, see auth.New
+	MaxStreamBytes int64           `json:"max_stream_bytes"` // quota of every stream, unlimited if 0
+	TTL            Duration        `json:"ttl"`              // how long streams live without activity
+	StorageBaseURL string          `json:"storage_base_url"` // overrides the server's
+
+	credentials *auth.Credentials
+}
+
+// Authenticate returns the principal of the request's basic auth
+// credentials if they're valid for the namespace. The principal is
+// limited to the namespace's keys.
+func (ns *Namespace) Authenticate(r *http.Request) (*auth.Principal, bool) {
+	principal, ok := ns.credentials.Authenticate(r)
+	if ok {
+		principal.Name = ns.Prefix + principal.Name
+		principal.Prefixes = []string{ns.Prefix}
+	}
+	return principal, ok
+}
+
+// HasCredentials tells whether the namespace has credentials of its own.
+func (ns *Namespace) HasCredentials() bool {
+	return !ns.credentials.Empty()
+}
+
+func (ns *Namespace) init() (err error) {
+	if ns.Prefix == "" {
+		return errors.New("Namespaces need a prefix.")
+	}
+
+	var creds string
+	if len(ns.Credentials) > 0 && ns.Credentials[0] == '"' {
+		err = json.Unmarshal(ns.Credentials, &creds)
+	} else {
+		creds = string(ns.Credentials)
+	}
+
+	if err == nil {
+		ns.credentials, err = auth.New(creds, "")
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid credentials for '%s': %v", ns.Prefix, err)
+	}
+	return nil
+}
+
+// Namespaces is a set of namespaces read from a JSON file holding
+// an array of them. It is safe for concurrent use.
+type Namespaces struct {
+	sync.RWMutex
+	path string
+	list []*Namespace // longest prefixes first
+}
+
+// Load reads the namespaces defined in the file at path.
+func Load(path string) (*Namespaces, error) {
+	n := &Namespaces{path: path}
+	return n, n.Reload()
+}
+
+// Reload rereads the namespaces file. Namespaces are left
+// untouched if it can't be read or parsed.
+func (n *Namespaces) Reload() error {
+	buf, err := ioutil.ReadFile(n.path)
+	if err != nil {
+		return err
+	}
+
+	var list []*Namespace
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return err
+	}
+
+	for _, ns := range list {
+		if err := ns.init(); err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return len(list[i].Prefix) > len(list[j].Prefix)
+	})
+
+	n.Lock()
+	n.list = list
+	n.Unlock()
+	return nil
+}
+
+// Lookup returns the namespace of key, i.e. the one with the longest
+// prefix of key, or nil if key doesn't belong to any.
+func (n *Namespaces) Lookup(key string) *Namespace {
+	if n == nil {
+		return nil
+	}
+
+	n.RLock()
+	defer n.RUnlock()
+
+	for _, ns := range n.list {
+		if strings.HasPrefix(key, ns.Prefix) {
+			return ns
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package namespace
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func load(t *testing.T, content string) (*Namespaces, error) {
+	f, _ := ioutil.TempFile("", "namespaces")
+	defer os.Remove(f.Name())
+
+	f.WriteString(content)
+	f.Close()
+	return Load(f.Name())
+}
+
+func TestLoad(t *testing.T) {
+	namespaces, err := load(t, `[
+		{"prefix": "app/", "credentials": "team:pass", "ttl": "10m", "max_stream_bytes": 1024},
+		{"prefix": "app/ci/", "credentials": [{"name": "ci", "password": "s3cret", "scopes": ["publish"]}]},
+		{"prefix": "open/", "storage_base_url": "https://bucket.example.com"}
+	]`)
+	assert.Nil(t, err)
+
+	app := namespaces.Lookup("app/1/2")
+	assert.Equal(t, "app/", app.Prefix)
+	assert.Equal(t, 10*time.Minute, app.TTL.Duration)
+	assert.Equal(t, int64(1024), app.MaxStreamBytes)
+	assert.True(t, app.HasCredentials())
+
+	// The longest prefix wins.
+	assert.Equal(t, "app/ci/", namespaces.Lookup("app/ci/1").Prefix)
+
+	open := namespaces.Lookup("open/1")
+	assert.Equal(t, "https://bucket.example.com", open.StorageBaseURL)
+	assert.False(t, open.HasCredentials())
+
+	assert.Nil(t, namespaces.Lookup("other/1"))
+
+	var none *Namespaces
+	assert.Nil(t, none.Lookup("app/1"))
+}
+
+func TestAuthenticate(t *testing.T) {
+	namespaces, _ := load(t, `[{"prefix": "app/", "credentials": "team:pass"}]`)
+	app := namespaces.Lookup("app/1")
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("team", "pass")
+
+	principal, ok := app.Authenticate(r)
+	assert.True(t, ok)
+	assert.Equal(t, "app/team", principal.Name)
+	assert.True(t, principal.Allows("app/1"))
+	assert.False(t, principal.Allows("other/1"))
+
+	r.SetBasicAuth("team", "wrong")
+	_, ok = app.Authenticate(r)
+	assert.False(t, ok)
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, content := range []string{
+		`{"prefix": "app/"}`,
+		`[{"credentials": "team:pass"}]`,
+		`[{"prefix": "app/", "credentials": "team:"}]`,
+		`[{"prefix": "app/", "ttl": "forever"}]`,
+	} {
+		_, err := load(t, content)
+		assert.NotNil(t, err, content)
+	}
+}
@@ -0,0 +1,169 @@
+// Package redact masks secrets out of streams before they are
+// buffered or stored.
+package redact
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+)
+
+// Mask replaces every redacted secret.
+const Mask = "[REDACTED]"
+
+// Bounds on the length of literal secrets. Shorter secrets would
+// mask ordinary output, longer ones would hold back too much of it.
+const (
+	MinSecretLength = 6
+	MaxSecretLength = 4096
+)
+
+// known errors
+var (
+	ErrShortSecret = errors.New("Secrets must be at least 6 bytes long.")
+	ErrLongSecret  = errors.New("Secrets must be at most 4096 bytes long.")
+)
+
+// DefaultPatterns match well known credentials. When a pattern has
+// a capture group, only the group is masked (e.g. the token but not
+// the `Bearer` before it). Bearer tokens are at least 20 characters,
+// so prose like "the bearer of bad news" is left alone.
+var DefaultPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`),
+	regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{20,}=*)`),
+}
+
+// Secret is a literal secret as it's stored: its length, a rolling
+// hash fingerprint to spot candidates and a salted SHA-256 digest to
+// confirm them. Multiline tells whether the secret contains newlines.
+type Secret struct {
+	Length      int    `json:"length"`
+	Fingerprint uint32 `json:"fingerprint"`
+	Digest      string `json:"digest"`
+	Multiline   bool   `json:"multiline,omitempty"`
+}
+
+// Secrets is a set of literal secrets which can be stored
+// without revealing them.
+type Secrets struct {
+	Salt    []byte   `json:"salt"`
+	Secrets []Secret `json:"secrets"`
+}
+
+// NewSecrets hashes plain text secrets with a fresh salt.
+func NewSecrets(plain []string) (*Secrets, error) {
+	s := &Secrets{Salt: make([]byte, 16)}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return nil, err
+	}
+
+	for _, secret := range plain {
+		switch {
+		case len(secret) < MinSecretLength:
+			return nil, ErrShortSecret
+		case len(secret) > MaxSecretLength:
+			return nil, ErrLongSecret
+		}
+
+		p := []byte(secret)
+		s.Secrets = append(s.Secrets, Secret{
+			Length:      len(p),
+			Fingerprint: fingerprint(p),
+			Digest:      s.digest(p),
+			Multiline:   bytes.IndexByte(p, '\n') >= 0,
+		})
+	}
+	return s, nil
+}
+
+func (s *Secrets) digest(p []byte) string {
+	h := sha256.New()
+	h.Write(s.Salt)
+	h.Write(p)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Rabin-Karp rolling hash, modulo 2^32.
+const base = 16777619
+
+func fingerprint(p []byte) (h uint32) {
+	for _, b := range p {
+		h = h*base + uint32(b)
+	}
+	return h
+}
+
+// span is a range of bytes to mask.
+type span struct {
+	start, end int
+}
+
+// find returns the spans of all secrets in p by rolling a
+// fingerprint over p for every distinct secret length.
+func (s *Secrets) find(p []byte) (spans []span) {
+	lengths := map[int]map[uint32][]string{}
+	for _, secret := range s.Secrets {
+		if lengths[secret.Length] == nil {
+			lengths[secret.Length] = map[uint32][]string{}
+		}
+		candidates := lengths[secret.Length]
+		candidates[secret.Fingerprint] = append(candidates[secret.Fingerprint], secret.Digest)
+	}
+
+	for n, candidates := range lengths {
+		if len(p) < n {
+			continue
+		}
+
+		// base^(n-1), to remove the byte leaving the window.
+		pow := uint32(1)
+		for i := 1; i < n; i++ {
+			pow *= base
+		}
+
+		h := fingerprint(p[:n])
+		for i := 0; ; i++ {
+			if digests, ok := candidates[h]; ok {
+				digest := s.digest(p[i : i+n])
+				for _, d := range digests {
+					if d == digest {
+						spans = append(spans, span{i, i + n})
+						break
+					}
+				}
+			}
+
+			if i+n >= len(p) {
+				break
+			}
+			h = (h-uint32(p[i])*pow)*base + uint32(p[i+n])
+		}
+	}
+	return spans
+}
+
+// hold returns how many bytes must be held back so that secrets
+// spanning newlines can't be split across writes.
+func (s *Secrets) hold() (n int) {
+	for _, secret := range s.Secrets {
+		if secret.Multiline && secret.Length-1 > n {
+			n = secret.Length - 1
+		}
+	}
+	return n
+}
+
+// holdPartial returns how many bytes must be held back so that no
+// secret can be split when a partial line is written.
+func (s *Secrets) holdPartial() (n int) {
+	for _, secret := range s.Secrets {
+		if secret.Length-1 > n {
+			n = secret.Length - 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,46 @@
+package redact
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSecrets(t *testing.T) {
+	secrets, err := NewSecrets([]string{"hunter22", "multi\nline"})
+	assert.Nil(t, err)
+	assert.Len(t, secrets.Secrets, 2)
+	assert.Equal(t, 9, secrets.hold())
+
+	// Nothing about the plain secrets but their length is stored.
+	buf, _ := json.Marshal(secrets)
+	assert.False(t, strings.Contains(string(buf), "hunter22"))
+
+	_, err = NewSecrets([]string{"short"})
+	assert.Equal(t, ErrShortSecret, err)
+
+	_, err = NewSecrets([]string{strings.Repeat("x", MaxSecretLength+1)})
+	assert.Equal(t, ErrLongSecret, err)
+}
+
+func TestFind(t *testing.T) {
+	secrets, _ := NewSecrets([]string{"hunter22", "s3cr3t-token"})
+
+	spans := secrets.find([]byte("hunter22 and s3cr3t-token, not hunter23"))
+	assert.Len(t, spans, 2)
+	assert.Contains(t, spans, span{0, 8})
+	assert.Contains(t, spans, span{13, 25})
+
+	assert.Empty(t, secrets.find([]byte("hunt")))
+}
+
+func TestFindAfterRoundTrip(t *testing.T) {
+	secrets, _ := NewSecrets([]string{"hunter22"})
+	buf, _ := json.Marshal(secrets)
+
+	stored := &Secrets{}
+	json.Unmarshal(buf, stored)
+	assert.Equal(t, []span{{4, 12}}, stored.find([]byte("pw: hunter22")))
+}
@@ -0,0 +1,196 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Output without a newline is held back up to this many bytes
+// before being redacted and written regardless.
+const maxHold = MaxSecretLength
+
+// Partial lines are written once nothing was written for flushDelay.
+var flushDelay = 100 * time.Millisecond
+
+type writer struct {
+	mu       sync.Mutex
+	w        io.WriteCloser
+	secrets  *Secrets
+	patterns []*regexp.Regexp
+	pending  []byte      // written but not yet redacted
+	timer    *time.Timer // writes partial lines
+	closed   bool
+	err      error // from writing partial lines
+}
+
+// NewWriter creates a writer masking secrets and pattern matches out
+// of everything written before handing it to w.
+//
+// Output is redacted a line at a time: a trailing partial line is held
+// back until its newline arrives, so secrets split across writes are
+// still found. Partial lines are redacted and written regardless when
+// nothing was written for 100ms or when they're longer than 4KB, only
+// holding back what could be the start of a secret, in which case a
+// pattern match spanning the cut can be missed. Close writes whatever
+// is held back and closes w.
+func NewWriter(w io.WriteCloser, secrets *Secrets, patterns []*regexp.Regexp) io.WriteCloser {
+	if secrets == nil {
+		secrets = &Secrets{}
+	}
+	return &writer{w: w, secrets: secrets, patterns: patterns}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.pending = append(w.pending, p...)
+	if err := w.flush(false, false); err != nil {
+		return len(p), err
+	}
+
+	switch {
+	case len(w.pending) == 0:
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+	case w.timer == nil:
+		w.timer = time.AfterFunc(flushDelay, w.flushPartial)
+	default:
+		w.timer.Reset(flushDelay)
+	}
+	return len(p), nil
+}
+
+// Writes the partial line held back, but what could be the start of
+// a secret, when nothing else was written in time.
+func (w *writer) flushPartial() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed && w.err == nil {
+		w.err = w.flush(true, false)
+	}
+}
+
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+
+	err := w.flush(true, true)
+	if cerr := w.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flush redacts and writes the pending bytes which can't be part
+// of a secret still being written, or all of them when final.
+// Partial lines are only written when partial.
+func (w *writer) flush(partial, final bool) error {
+	cut := len(w.pending)
+	if !final {
+		hold := w.secrets.hold()
+		if partial {
+			hold = w.secrets.holdPartial()
+		} else {
+			cut = bytes.LastIndexByte(w.pending, '\n') + 1
+		}
+		if n := len(w.pending) - hold; n < cut {
+			cut = maxInt(n, 0)
+		}
+		if n := len(w.pending) - maxHold; n > cut {
+			cut = n
+		}
+	}
+
+	spans := w.find(w.pending)
+
+	// Never cut through a match: complete ones are written at once,
+	// ones reaching the end might still grow and are held back, unless
+	// they're already too long, in which case what we have is masked.
+	for i, s := range spans {
+		if s.start < cut && s.end > cut && !final {
+			switch {
+			case s.end < len(w.pending):
+				cut = s.end
+			case len(w.pending)-s.start <= maxHold:
+				cut = s.start
+			default:
+				spans[i].end = cut
+			}
+			break
+		}
+	}
+
+	if cut == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, s := range spans {
+		if s.end > cut {
+			break
+		}
+		buf.Write(w.pending[last:s.start])
+		buf.WriteString(Mask)
+		last = s.end
+	}
+	buf.Write(w.pending[last:cut])
+
+	w.pending = append([]byte{}, w.pending[cut:]...)
+
+	_, err := w.w.Write(buf.Bytes())
+	return err
+}
+
+// find returns the sorted and merged spans of all
+// secrets and pattern matches in p.
+func (w *writer) find(p []byte) []span {
+	spans := w.secrets.find(p)
+
+	for _, pattern := range w.patterns {
+		for _, loc := range pattern.FindAllSubmatchIndex(p, -1) {
+			s := span{loc[0], loc[1]}
+			if len(loc) > 2 && loc[2] >= 0 {
+				s = span{loc[2], loc[3]}
+			}
+			if s.end > s.start {
+				spans = append(spans, s)
+			}
+		}
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var merged []span
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s.start <= merged[n-1].end {
+			merged[n-1].end = maxInt(merged[n-1].end, s.end)
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+	"github.com/heroku/busl/webhook"
+)
+
+// Admins see up to maxAdminStreams of the newest streams.
+const maxAdminStreams = 1000
+
+// Every instance reports its connections to the broker every
+// reportInterval, and they're forgotten if it stops for reportTTL.
+var (
+	reportInterval = 10 * time.Second
+	reportTTL      = 3 * reportInterval
+)
+
+// connections tracks the publishers and subscribers connected
+// to an instance, so they can be listed and dropped.
+type connections struct {
+	sync.Mutex
+	instance string
+	conns    map[string]*connection
+}
+
+type connection struct {
+	broker.Connection
+	dropped chan struct{}
+	once    sync.Once
+}
+
+func (c *connection) drop() {
+	c.once.Do(func() { close(c.dropped) })
+}
+
+func newConnections() *connections {
+	instance, _ := util.NewUUID()
+	return &connections{instance: string(instance), conns: make(map[string]*connection)}
+}
+
+// Tracks a publisher or subscriber of the requested stream, connected
+// from remoteAddr. The returned channel is closed when the connection
+// is to be dropped.
+func (cs *connections) track(kind string, r *http.Request, remoteAddr string) (dropped <-chan struct{}, untrack func()) {
+	id, _ := util.NewUUID()
+	c := &connection{
+		Connection: broker.Connection{
+			ID:         string(id),
+			Key:        key(r),
+			Kind:       kind,
+			RemoteAddr: remoteAddr,
+			Since:      time.Now().UTC(),
+			Instance:   cs.instance,
+		},
+		dropped: make(chan struct{}),
+	}
+
+	cs.Lock()
+	cs.conns[c.ID] = c
+	cs.Unlock()
+
+	return c.dropped, func() {
+		cs.Lock()
+		delete(cs.conns, c.ID)
+		cs.Unlock()
+	}
+}
+
+func (cs *connections) list() []broker.Connection {
+	cs.Lock()
+	defer cs.Unlock()
+
+	conns := make([]broker.Connection, 0, len(cs.conns))
+	for _, c := range cs.conns {
+		conns = append(conns, c.Connection)
+	}
+	return conns
+}
+
+// Drops the connections matching fn.
+func (cs *connections) drop(fn func(c *connection) bool) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	for _, c := range cs.conns {
+		if fn(c) {
+			c.drop()
+		}
+	}
+}
+
+func (cs *connections) report() error {
+	return broker.ReportConnections(cs.instance, cs.list(), reportTTL)
+}
+
+// Reports the connections to the broker and applies the
+// commands sent by admins to every instance, until stop is closed.
+func (cs *connections) run(stop <-chan struct{}) {
+	go func() {
+		for {
+			if err := cs.report(); err != nil {
+				util.CountWithData("server.admin.report.error", 1, "error=%q", err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(reportInterval):
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			err := broker.ReceiveCommands(stop, func(command, arg string) {
+				switch command {
+				case broker.CommandClose:
+					cs.drop(func(c *connection) bool { return c.Key == arg && c.Kind == "publisher" })
+				case broker.CommandDisconnect:
+					cs.drop(func(c *connection) bool { return c.ID == arg })
+				}
+			})
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			util.CountWithData("server.admin.commands.error", 1, "error=%q", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// streamStatus is how admins see a stream.
+type streamStatus struct {
+	Key         string              `json:"key"`
+	Bytes       int64               `json:"bytes"`
+	Done        bool                `json:"done"`
+	Publisher   bool                `json:"publisher"`
+	Subscribers int                 `json:"subscribers"`
+	Age         float64             `json:"age,omitempty"` // seconds since the stream was created
+	TTL         float64             `json:"ttl"`           // seconds until the stream expires
+	Connections []broker.Connection `json:"connections,omitempty"`
+	Status      *completion         `json:"status,omitempty"` // as given by the publisher
+}
+
+func newStreamStatus(stream broker.Stream, conns []broker.Connection) *streamStatus {
+	status := &streamStatus{
+		Key:   stream.Key,
+		Bytes: stream.Bytes,
+		Done:  stream.Done,
+		TTL:   stream.TTL.Seconds(),
+	}
+	if !stream.Created.IsZero() {
+		status.Age = time.Since(stream.Created).Seconds()
+	}
+
+	for _, c := range conns {
+		if c.Key != stream.Key {
+			continue
+		}
+		if c.Kind == "publisher" {
+			status.Publisher = true
+		} else {
+			status.Subscribers++
+		}
+	}
+	return status
+}
+
+// Lists the connections of the fleet, or of this
+// instance only if `?local=true`.
+func (s *Server) connections(r *http.Request) ([]broker.Connection, error) {
+	if r.URL.Query().Get("local") == "true" {
+		return s.conns.list(), nil
+	}
+
+	// Don't wait for the next report to show this instance's.
+	if err := s.conns.report(); err != nil {
+		return nil, err
+	}
+	return broker.Connections()
+}
+
+// Lists the newest registered streams, or those with a publisher or
+// subscriber connected to this instance if `?local=true`.
+func (s *Server) adminStreams(w http.ResponseWriter, r *http.Request) {
+	conns, err := s.connections(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	streams, err := broker.Streams(maxAdminStreams)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	local := r.URL.Query().Get("local") == "true"
+	list := make([]*streamStatus, 0, len(streams))
+	for _, stream := range streams {
+		status := newStreamStatus(stream, conns)
+		if local && !status.Publisher && status.Subscribers == 0 {
+			continue
+		}
+		list = append(list, status)
+	}
+	sort.Sort(byKey(list))
+
+	writeJSON(w, list)
+}
+
+// Describes a stream and lists its connections.
+func (s *Server) adminStream(w http.ResponseWriter, r *http.Request) {
+	stream, err := broker.StreamInfo(key(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	conns, err := s.connections(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	status := newStreamStatus(stream, conns)
+	for _, c := range conns {
+		if c.Key == stream.Key {
+			status.Connections = append(status.Connections, c)
+		}
+	}
+	if status.Status, err = loadCompletion(stream.Key); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// Closes a stream, disconnecting its publishers.
+func (s *Server) adminClose(w http.ResponseWriter, r *http.Request) {
+	if err := broker.CloseStream(key(r)); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	util.CountWithData("server.admin.close", 1, "key=%s", key(r))
+	s.notify(webhook.Completed, key(r), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Drops a publisher or subscriber, wherever it's connected.
+func (s *Server) adminDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	conns, err := s.connections(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	for _, c := range conns {
+		if c.ID != id {
+			continue
+		}
+
+		if err := broker.Disconnect(id); err != nil {
+			handleError(w, r, err)
+			return
+		}
+		util.CountWithData("server.admin.disconnect", 1, "key=%s", c.Key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "Connection not found.", http.StatusNotFound)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+type byKey []*streamStatus
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers browsers may send and read cross-origin, unless configured.
+var (
+	defaultCORSAllowHeaders = []string{
+		"Accept", "Authorization", "Content-Type", "Content-Length", "Accept-Encoding",
+		"Last-Event-ID", "Range", "X-CSRF-Token", "Busl-Token",
+	}
+	defaultCORSExposeHeaders = []string{
+		"Cache-Control", "Content-Type", "Expires", "Last-Modified",
+		"Busl-Read-Token", "Busl-Write-Token", "Retry-After", "Busl-Next-Offset", "Busl-Done",
+	}
+)
+
+const corsAllowMethods = "GET, POST, PUT, DELETE, OPTIONS"
+
+// Returns the Access-Control-Allow-Origin for origin and whether
+// credentials may be sent along, or "" if origin isn't allowed.
+//
+// Without CORSOrigins every origin is reflected, with credentials, as
+// busl always did. Entries are origins (https://example.com), wildcard
+// subdomains (https://*.example.com, *.example.com for any scheme) or
+// * for every origin, without credentials.
+func (s *Server) allowOrigin(origin string) (allow string, credentials bool) {
+	if len(s.CORSOrigins) == 0 {
+		return origin, true
+	}
+
+	for _, pattern := range s.CORSOrigins {
+		if originMatches(pattern, origin) {
+			return origin, true
+		}
+	}
+
+	for _, pattern := range s.CORSOrigins {
+		if pattern == "*" {
+			return "*", false
+		}
+	}
+	return "", false
+}
+
+func originMatches(pattern, origin string) bool {
+	i := strings.Index(pattern, "*.")
+	if i < 0 {
+		return pattern == origin
+	}
+
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if !strings.HasPrefix(origin, prefix) {
+		return false
+	}
+
+	host := origin[len(prefix):]
+	return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+}
+
+// Sets the CORS response headers of a request from an allowed origin.
+func (s *Server) corsHeaders(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	allow, credentials := s.allowOrigin(origin)
+	if allow == "" {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allow)
+	if allow != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+	if credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	expose := s.CORSExposeHeaders
+	if expose == nil {
+		expose = defaultCORSExposeHeaders
+	}
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+	return true
+}
+
+// Answers CORS preflight requests. These never carry
+// credentials, so they're handled ahead of authentication.
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request) {
+	if s.corsHeaders(w, r) {
+		allowHeaders := s.CORSAllowHeaders
+		if allowHeaders == nil {
+			allowHeaders = defaultCORSAllowHeaders
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(allowHeaders, ", "))
+		if s.CORSMaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(s.CORSMaxAge/time.Second)))
+		}
+	}
+
+	w.Header().Set("Allow", corsAllowMethods)
+	w.WriteHeader(http.StatusNoContent)
+}
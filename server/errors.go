@@ -3,13 +3,19 @@ package server
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/redact"
 	"github.com/heroku/busl/storage"
 	"github.com/heroku/busl/util"
 )
 
-var errNoContent = errors.New("No Content")
+var (
+	errNoContent   = errors.New("No Content")
+	errInvalidANSI = errors.New("Invalid ansi parameter.")
+)
 
 const asciiGone = `░░░░░░░░░░██░░░░░░░░░░██░░░░░░░░
 ░░░░░░░░██░░██░░░░░░██░░██░░░░░░
@@ -29,6 +35,16 @@ const asciiGone = `░░░░░░░░░░██░░░░░░░░
 ░░░░██░░░░██░░██░░██░░██░░░░░░░░`
 
 func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if limited, ok := err.(*broker.RateLimitError); ok {
+		retryAfter := (limited.RetryAfter + time.Second - 1) / time.Second
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
 	switch err {
 	case broker.ErrNotRegistered, storage.ErrNoStorage, storage.ErrNotFound:
 		message := "Channel is not registered."
@@ -38,6 +54,17 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 
 		http.Error(w, message, http.StatusNotFound)
 
+	case errInvalidTail, errInvalidSince, errInvalidANSI, errInvalidLimit, errInvalidCursor,
+		errInvalidSecrets, errInvalidStatus, errReservedKey, errInvalidOffset, errInvalidWait, errInvalidMax, redact.ErrShortSecret, redact.ErrLongSecret:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+	case broker.ErrQuotaExceeded:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+
+	case errInvalidToken:
+		w.Header().Set("WWW-Authenticate", `Busl-Token realm="busl"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
 	case storage.ErrRange:
 		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 
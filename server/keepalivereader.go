@@ -1,44 +1,314 @@
 package server
 
 import (
+	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/encoders"
 	"github.com/heroku/busl/util"
 )
 
+var (
+	errSlowSubscriber = errors.New("subscriber too slow")
+	errClosed         = errors.New("subscription closed")
+)
+
+// Slow subscriber policies.
+const (
+	policyDisconnect = "disconnect" // end the subscription, to be resumed from its final offset
+	policySkip       = "skip"       // skip ahead to what's being published, marking the gap
+)
+
+// Subscribers have up to defaultSubscriberBuffer bytes read ahead,
+// unless configured otherwise, in up to maxPayloads payloads of up to
+// payloadSize bytes. Reading ahead then waits for them, unless they
+// didn't read anything for slowSubscriberGrace, unless configured
+// otherwise: they're slow, and their policy applies. Their lag is
+// observed at most every lagInterval.
+const (
+	defaultSubscriberBuffer = 4 << 20
+	payloadSize             = 32 << 10
+	maxPayloads             = 100
+)
+
+var (
+	slowSubscriberGrace = 30 * time.Second
+	lagInterval         = 10 * time.Second
+)
+
 type payload struct {
-	p   []byte
-	n   int
-	err error
+	p      []byte
+	n      int
+	err    error
+	offset int64 // in the stream, right after p
+}
+
+// slowPolicy tells what becomes of slow subscribers, which have limit
+// bytes read ahead for them and didn't read anything for grace.
+// Without skip, they're disconnected.
+// Otherwise skip reopens the stream at the offset the producer is at,
+// or from if it isn't ahead of it. head returns the offset the
+// producer is at.
+type slowPolicy struct {
+	limit int64
+	grace time.Duration
+	skip  func(from int64) (rd io.Reader, offset int64, err error)
+	head  func() (int64, error)
 }
 
 type keepAliveReader struct {
-	r        io.Reader
-	packet   []byte        // typically a null byte
-	interval time.Duration // duration before sending an ack
-	ch       chan *payload // where all the original reads go to
-	done     <-chan bool   // closeNotifier
-	eof      bool          // marked true when we hit EOF
+	mu       sync.Mutex
+	r        io.Reader       // nil while skipping ahead
+	closed   bool            // marked true once closed
+	packet   []byte          // typically a null byte
+	interval time.Duration   // duration before sending an ack
+	policy   slowPolicy      // for subscribers falling behind
+	ch       chan *payload   // where all the original reads go to
+	stop     chan struct{}   // closed when the reader is closed
+	progress chan struct{}   // signaled when the subscriber read something
+	stalled  chan struct{}   // closed when the subscriber doesn't catch up in time
+	stall    sync.Once       // closes stalled
+	done     <-chan bool     // closeNotifier
+	dropped  <-chan struct{} // closed when an admin drops the subscriber
+	eof      bool            // marked true when we hit EOF
+	observed time.Time       // when the lag was last observed
+
+	offset   int64 // in the stream right after what was read, accessed atomically
+	buffered int64 // bytes read ahead, accessed atomically
+	behind   int32 // 1 while a slow subscriber is behind, accessed atomically
+	slow     int32 // 1 once disconnected for being slow, accessed atomically
+	skipped  int64 // bytes skipped, accessed atomically
+}
+
+// Reads from r, which starts at offset in the stream. Encoders
+// tell their offset; other readers read the stream as is.
+func newKeepAliveReader(r io.Reader, offset int64, packet []byte, interval time.Duration, done <-chan bool, dropped <-chan struct{}, policy slowPolicy) *keepAliveReader {
+	if policy.limit <= 0 {
+		policy.limit = defaultSubscriberBuffer
+	}
+	if policy.grace <= 0 {
+		policy.grace = slowSubscriberGrace
+	}
+
+	ka := &keepAliveReader{
+		r:        r,
+		ch:       make(chan *payload, maxPayloads),
+		stop:     make(chan struct{}),
+		progress: make(chan struct{}, 1),
+		stalled:  make(chan struct{}),
+		done:     done,
+		dropped:  dropped,
+		packet:   packet,
+		interval: interval,
+		policy:   policy,
+		offset:   offset,
+		observed: time.Now(),
+	}
+	go ka.readAhead(r, offset)
+	return ka
+}
+
+// Reads from rd until it's done, or the subscriber is slow and
+// disconnected, queueing what was read for Read.
+func (r *keepAliveReader) readAhead(rd io.Reader, offset int64) {
+	for {
+		p := r.read(rd, offset)
+
+		room, open := r.waitRoom(p.n)
+		if !open {
+			return
+		}
+		if !room {
+			r.fallBehind()
+
+			var err error
+			rd, offset, err = r.skipAhead(rd, p, offset)
+			if err == errSlowSubscriber {
+				// Ends the body once what was queued is read,
+				// so the final offset still reaches the subscriber.
+				atomic.StoreInt32(&r.slow, 1)
+				r.push(&payload{err: err, offset: offset})
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		if !r.push(p) || p.err != nil {
+			return
+		}
+		offset = p.offset
+	}
 }
 
-func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done <-chan bool) io.ReadCloser {
-	ch := make(chan *payload, 100)
+func (r *keepAliveReader) read(rd io.Reader, offset int64) *payload {
+	p := &payload{p: make([]byte, payloadSize)}
+	p.n, p.err = rd.Read(p.p)
 
-	go func() {
-		for {
-			payload := &payload{p: make([]byte, 1024*32)}
-			payload.n, payload.err = r.Read(payload.p)
-			ch <- payload
+	p.offset = offset + int64(p.n)
+	if encoder, ok := rd.(encoders.Encoder); ok {
+		p.offset = encoder.Offset()
+	}
+	return p
+}
 
-			if payload.err != nil {
-				break
+// Queues a payload for Read, telling whether
+// it was rather dropped because r was closed.
+func (r *keepAliveReader) push(p *payload) bool {
+	atomic.AddInt64(&r.buffered, int64(p.n))
+	select {
+	case r.ch <- p:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+// Waits until n more bytes can be queued, keeping a slot free for
+// errSlowSubscriber or a gap marker. It tells whether there's room,
+// or rather the subscriber didn't read anything for
+// grace, and whether r is still open.
+func (r *keepAliveReader) waitRoom(n int) (room, open bool) {
+	timer := time.NewTimer(r.policy.grace)
+	defer timer.Stop()
+
+	for r.full(n) {
+		select {
+		case <-r.progress:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
 			}
+			timer.Reset(r.policy.grace)
+		case <-timer.C:
+			return false, true
+		case <-r.stop:
+			return false, false
 		}
-	}()
+	}
+	return true, true
+}
 
-	return &keepAliveReader{r: r, ch: ch, done: done, packet: packet, interval: interval}
+func (r *keepAliveReader) full(n int) bool {
+	buffered := atomic.LoadInt64(&r.buffered)
+	return buffered > 0 && buffered+int64(n) > r.policy.limit || len(r.ch) >= cap(r.ch)-1
+}
+
+// Counts a slow subscriber. Those skipping ahead are cut off
+// unless they catch up within grace.
+func (r *keepAliveReader) fallBehind() {
+	policy := policyDisconnect
+	if r.policy.skip != nil {
+		policy = policySkip
+	}
+	util.CountWithData("server.sub.slow", 1, "policy=%s", policy)
+	slowSubscribers.Inc(policy)
+	r.observeLag()
+
+	if r.policy.skip != nil {
+		atomic.StoreInt32(&r.behind, 1)
+		time.AfterFunc(r.policy.grace, func() {
+			if atomic.LoadInt32(&r.behind) == 1 {
+				r.cutOff()
+			}
+		})
+	}
+}
+
+func (r *keepAliveReader) cutOff() {
+	r.stall.Do(func() { close(r.stalled) })
+}
+
+// Skips ahead of p, which couldn't be queued after offset, returning
+// the reader to go on with and its offset. errSlowSubscriber tells
+// that the subscriber is rather disconnected; other errors that
+// the subscription is over. Frames partly queued are completed
+// first, and the stream is reopened with a gap marker once the
+// subscriber caught up with what was queued.
+func (r *keepAliveReader) skipAhead(rd io.Reader, p *payload, offset int64) (io.Reader, int64, error) {
+	if r.policy.skip == nil {
+		return nil, offset, errSlowSubscriber
+	}
+
+	from := offset
+	if encoder, ok := rd.(encoders.Encoder); ok && encoder.Buffered() > 0 {
+		for encoder.Buffered() > 0 {
+			if !r.push(p) {
+				return nil, offset, errClosed
+			}
+			if p.err != nil {
+				return nil, p.offset, p.err
+			}
+			p = r.read(rd, p.offset)
+		}
+		from = encoder.Offset()
+	}
+
+	// Nothing is kept open while the subscriber catches up.
+	if !r.swap(nil) {
+		return nil, from, errClosed
+	}
+	for atomic.LoadInt64(&r.buffered) > 0 || len(r.ch) > 0 {
+		select {
+		case <-r.progress:
+		case <-r.stop:
+			return nil, from, errClosed
+		}
+	}
+
+	next, to, err := r.policy.skip(from)
+	if err != nil {
+		return nil, from, errSlowSubscriber
+	}
+	if !r.swap(next) {
+		return nil, from, errClosed
+	}
+	if to <= from {
+		return next, to, nil
+	}
+
+	util.CountWithData("server.sub.skipped", 1, "bytes=%d", to-from)
+	skippedBytes.Add(float64(to - from))
+	atomic.AddInt64(&r.skipped, to-from)
+
+	gap := &payload{offset: to}
+	if encoder, ok := next.(encoders.Encoder); ok {
+		gap.p = encoder.Gap(from, to)
+		gap.n = len(gap.p)
+	}
+	if !r.push(gap) {
+		return nil, to, errClosed
+	}
+	return next, to, nil
+}
+
+// Closes the current reader and replaces it with rd, telling
+// whether r is still open. rd is closed rather than kept if not.
+func (r *keepAliveReader) swap(rd io.Reader) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	closeReader(r.r)
+	r.r = nil
+	if r.closed {
+		closeReader(rd)
+		return false
+	}
+	r.r = rd
+	return true
+}
+
+func (r *keepAliveReader) reader() io.Reader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r
 }
 
 func (r *keepAliveReader) Read(p []byte) (int, error) {
@@ -54,7 +324,12 @@ func (r *keepAliveReader) Read(p []byte) (int, error) {
 		if payload.n > 0 {
 			copy(p, payload.p[0:payload.n])
 		}
+		atomic.StoreInt64(&r.offset, payload.offset)
+		r.delivered(payload.n)
 
+		if payload.err == errSlowSubscriber {
+			payload.err = io.EOF
+		}
 		if payload.err == io.EOF {
 			r.eof = true
 		}
@@ -63,18 +338,86 @@ func (r *keepAliveReader) Read(p []byte) (int, error) {
 
 	case <-timer.C:
 		util.Count("server.sub.keepAlive")
-		broker.RenewExpiry(r.r)
+		keepAlives.Inc()
+		broker.RenewExpiry(r.reader())
+		r.observed = time.Now()
+		r.observeLag()
 		return copy(p, r.packet), nil
 
 	case <-r.done:
 		util.Count("server.sub.clientClosed")
 		r.eof = true
 		return 0, io.EOF
+
+	case <-r.dropped:
+		util.Count("server.sub.dropped")
+		r.eof = true
+		return 0, io.EOF
+	}
+}
+
+// Accounts for n bytes handed to the subscriber.
+func (r *keepAliveReader) delivered(n int) {
+	if atomic.AddInt64(&r.buffered, -int64(n)) == 0 && len(r.ch) == 0 {
+		atomic.StoreInt32(&r.behind, 0)
+	}
+	select {
+	case r.progress <- struct{}{}:
+	default:
+	}
+
+	if time.Since(r.observed) >= lagInterval {
+		r.observed = time.Now()
+		r.observeLag()
+	}
+}
+
+// Observes how far behind the producer the subscriber is.
+func (r *keepAliveReader) observeLag() {
+	if r.policy.head == nil {
+		return
+	}
+	if head, err := r.policy.head(); err == nil && head >= r.Offset() {
+		subscriberLag.Observe(float64(head - r.Offset()))
 	}
 }
 
+// Offset returns the offset in the stream right after what was read.
+func (r *keepAliveReader) Offset() int64 {
+	return atomic.LoadInt64(&r.offset)
+}
+
+// Slow tells whether the subscriber was disconnected for being slow.
+func (r *keepAliveReader) Slow() bool {
+	return atomic.LoadInt32(&r.slow) == 1
+}
+
+// Skipped returns how many bytes of the stream were skipped.
+func (r *keepAliveReader) Skipped() int64 {
+	return atomic.LoadInt64(&r.skipped)
+}
+
+// Stalled is closed when the subscriber should be cut off at once:
+// it didn't catch up in time after skipping ahead.
+func (r *keepAliveReader) Stalled() <-chan struct{} {
+	return r.stalled
+}
+
 func (r *keepAliveReader) Close() error {
-	if closer, ok := r.r.(io.Closer); ok {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.closed {
+		close(r.stop)
+		r.closed = true
+	}
+	rd := r.r
+	r.r = nil
+	return closeReader(rd)
+}
+
+func closeReader(rd io.Reader) error {
+	if closer, ok := rd.(io.Closer); ok {
 		return closer.Close()
 	}
 	return nil
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+// Limits are enforced through the broker, so they hold across every
+// busl instance. When the broker can't be reached requests go through
+// rather than failing.
+
+// Refuses stream creations past CreateRateLimit per minute, counted
+// per principal or, for anonymous requests, per client IP.
+func (s *Server) limitCreates(fn http.HandlerFunc) http.HandlerFunc {
+	if s.CreateRateLimit <= 0 {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := "ip:" + s.clientIP(r)
+		if logger, ok := w.(*util.ResponseLogger); ok && logger.Principal() != "" {
+			client = "principal:" + logger.Principal()
+		}
+
+		err := broker.Throttle("creates:"+client, int64(s.CreateRateLimit), 1, time.Minute)
+		if limited(w, r, err) {
+			util.CountWithData("server.limit.creates", 1, "client=%s", client)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// Refuses subscribers past MaxStreamSubscribers for the stream
+// or MaxIPSubscribers for the client IP.
+func (s *Server) limitSubscribers(fn http.HandlerFunc) http.HandlerFunc {
+	if s.MaxStreamSubscribers <= 0 && s.MaxIPSubscribers <= 0 {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.MaxStreamSubscribers > 0 {
+			release, err := broker.Acquire("subscribers:stream:"+key(r), s.MaxStreamSubscribers)
+			if limited(w, r, err) {
+				util.CountWithData("server.limit.subscribers", 1, "key=%s", key(r))
+				return
+			}
+			if release != nil {
+				defer release()
+			}
+		}
+
+		if s.MaxIPSubscribers > 0 {
+			ip := s.clientIP(r)
+			release, err := broker.Acquire("subscribers:ip:"+ip, s.MaxIPSubscribers)
+			if limited(w, r, err) {
+				util.CountWithData("server.limit.subscribers", 1, "ip=%s", ip)
+				return
+			}
+			if release != nil {
+				defer release()
+			}
+		}
+
+		fn(w, r)
+	}
+}
+
+// Responds with the error if a limit was hit. Other errors are
+// counted and let through.
+func limited(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, ok := err.(*broker.RateLimitError); ok {
+		handleError(w, r, err)
+		return true
+	}
+
+	util.CountWithData("server.limit.error", 1, "error=%s", err)
+	return false
+}
+
+// throttledWriter slows writes down to a stream's PublishRateLimit
+// bytes per second: once it's reached, writes wait for the next
+// window rather than failing what's being published.
+type throttledWriter struct {
+	io.WriteCloser
+	key   string
+	limit int64
+}
+
+// Refuses publishers of streams already past their rate, before
+// anything of theirs is read.
+func (w *throttledWriter) admit() error {
+	err := broker.Throttle("publish:"+w.key, w.limit, 0, time.Second)
+	if _, ok := err.(*broker.RateLimitError); ok {
+		return err
+	}
+	if err != nil {
+		util.CountWithData("server.limit.error", 1, "error=%s", err)
+	}
+	return nil
+}
+
+func (w *throttledWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > w.limit {
+			chunk = chunk[:w.limit]
+		}
+
+		err := broker.Throttle("publish:"+w.key, w.limit, int64(len(chunk)), time.Second)
+		if limited, ok := err.(*broker.RateLimitError); ok {
+			util.CountWithData("server.limit.publish", 1, "key=%s", w.key)
+			time.Sleep(limited.RetryAfter + time.Millisecond)
+			continue
+		}
+		if err != nil {
+			util.CountWithData("server.limit.error", 1, "error=%s", err)
+		}
+
+		m, err := w.WriteCloser.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// Returns the client's IP. Behind a trusted proxy such as the Heroku
+// router, that's the last X-Forwarded-For entry, which the proxy added;
+// earlier ones can be forged. Otherwise X-Forwarded-For can be forged
+// altogether and the peer's address is used.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && s.trustedProxy(host) {
+		parts := strings.Split(fwd, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	return host
+}
+
+func (s *Server) trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range s.TrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
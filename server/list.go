@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+// Streams are listed in pages of defaultListLimit, or of up
+// to maxListLimit with `?limit=`.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+var (
+	errInvalidLimit  = errors.New("Invalid limit parameter.")
+	errInvalidCursor = errors.New("Invalid cursor parameter.")
+)
+
+type listedStream struct {
+	Key     string     `json:"key"`
+	Size    int64      `json:"size"`
+	Done    bool       `json:"done"`
+	Created *time.Time `json:"created,omitempty"`
+}
+
+type streamList struct {
+	Streams []listedStream `json:"streams"`
+	Cursor  string         `json:"cursor,omitempty"` // of the next page, if any
+}
+
+// Requires credentials granting the list scope on `?prefix=`, whatever
+// the authenticated scopes. Only admins list every stream at once.
+func (s *Server) listAuth(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+
+		principal, ok := s.authenticate(r, s.namespace(prefix))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="busl"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if logger, ok := w.(*util.ResponseLogger); ok {
+			logger.SetPrincipal(principal.Name)
+		}
+
+		if !principal.Can(auth.List) || !principal.Allows(prefix) || prefix == "" && !principal.Can(auth.Admin) {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// Lists the registered streams whose keys start with `?prefix=`,
+// continuing after the page of `?cursor=` if given.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	limit := defaultListLimit
+	if val := query.Get("limit"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 || n > maxListLimit {
+			handleError(w, r, errInvalidLimit)
+			return
+		}
+		limit = n
+	}
+
+	after, err := parseCursor(query.Get("cursor"), prefix)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	streams, next, err := broker.ListStreams(prefix, after, limit)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	list := streamList{Streams: make([]listedStream, 0, len(streams))}
+	for _, stream := range streams {
+		listed := listedStream{Key: stream.Key, Size: stream.Bytes, Done: stream.Done}
+		if !stream.Created.IsZero() {
+			created := stream.Created.UTC()
+			listed.Created = &created
+		}
+		list.Streams = append(list.Streams, listed)
+	}
+	if next != "" {
+		list.Cursor = newCursor(next)
+	}
+	annotate(w, "prefix", prefix, "listed", len(list.Streams))
+
+	writeJSON(w, list)
+}
+
+// Matches listings, which have a `?prefix=`, even if empty.
+func hasPrefix(r *http.Request, _ *mux.RouteMatch) bool {
+	_, ok := r.URL.Query()["prefix"]
+	return ok
+}
+
+// Cursors are the key a page ends after, opaque to clients.
+func newCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func parseCursor(cursor, prefix string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(key), prefix) {
+		return "", errInvalidCursor
+	}
+	return string(key), nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/heroku/busl/metrics"
+)
+
+var (
+	subscribers     = metrics.NewGauge("busl_subscribers", "Active subscribers.")
+	publishers      = metrics.NewGauge("busl_publishers", "Active publishers.")
+	publishedBytes  = metrics.NewCounter("busl_published_bytes_total", "Bytes published.")
+	deliveredBytes  = metrics.NewCounter("busl_delivered_bytes_total", "Bytes delivered to subscribers, keepalives and encoding included.")
+	keepAlives      = metrics.NewCounter("busl_keepalives_total", "Keepalives sent to subscribers.")
+	slowSubscribers = metrics.NewCounter("busl_slow_subscribers_total", "Subscribers which fell too far behind, by policy.", "policy")
+	skippedBytes    = metrics.NewCounter("busl_skipped_bytes_total", "Bytes skipped for slow subscribers.")
+	subscriberLag   = metrics.DefaultRegistry.NewHistogram("busl_subscriber_lag_bytes", "Bytes between the offset of producers and of their subscribers.", lagBuckets)
+	responses       = metrics.NewCounter("busl_http_responses_total", "HTTP responses, by route and status code.", "route", "code")
+)
+
+// Lag buckets, from a kilobyte to a gigabyte.
+var lagBuckets = []float64{1 << 10, 8 << 10, 64 << 10, 512 << 10, 4 << 20, 32 << 20, 256 << 20, 1 << 30}
+
+// Returns the route of a request, keeping the cardinality
+// of the metrics labelled with it bounded.
+func route(r *http.Request) string {
+	switch path := r.URL.Path; {
+	case path == "/health", path == "/metrics", path == "/streams":
+		return path
+	case strings.HasPrefix(path, "/streams/"):
+		return "/streams/{key}"
+	case path == "/admin/streams":
+		return path
+	case strings.HasPrefix(path, "/admin/streams/"):
+		return "/admin/streams/{key}"
+	case strings.HasPrefix(path, "/admin/connections/"):
+		return "/admin/connections/{id}"
+	}
+	return "other"
+}
+
+func countResponse(r *http.Request, status int) {
+	responses.Inc(route(r), strconv.Itoa(status))
+}
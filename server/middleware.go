@@ -2,19 +2,21 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
-	"github.com/heroku/authenticater"
+	"github.com/heroku/busl/auth"
 	"github.com/heroku/busl/broker"
 	"github.com/heroku/busl/encoders"
+	"github.com/heroku/busl/namespace"
 	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
+	"github.com/heroku/busl/webhook"
 )
 
 func (s *Server) enforceHTTPS(fn http.HandlerFunc) http.HandlerFunc {
@@ -23,7 +25,7 @@ func (s *Server) enforceHTTPS(fn http.HandlerFunc) http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "https" {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "https" && r.TLS == nil {
 			url := r.URL
 			url.Host = r.Host
 			url.Scheme = "https"
@@ -36,36 +38,149 @@ func (s *Server) enforceHTTPS(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func (s *Server) auth(fn http.HandlerFunc) http.HandlerFunc {
-	if s.Credentials == "" {
-		return fn
+// Requires credentials granting scope on the requested key, if scope
+// is one of the authenticated scopes and there are credentials at all,
+// signed URLs being those of subscribers. Keys of namespaces with
+// credentials always require them, whatever the scope.
+func (s *Server) auth(scope auth.Scope, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns := s.namespace(key(r))
+		if !s.authenticated(scope) && (ns == nil || !ns.HasCredentials()) {
+			fn(w, r)
+			return
+		}
+
+		signed := scope == auth.Subscribe && s.SigningKey != ""
+		if s.credentials.Empty() && s.jwt == nil && s.TLSClientCAFile == "" && !signed && (ns == nil || !ns.HasCredentials()) {
+			fn(w, r)
+			return
+		}
+
+		principal, ok := s.authenticate(r, ns)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="busl"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if logger, ok := w.(*util.ResponseLogger); ok {
+			logger.SetPrincipal(principal.Name)
+		}
+
+		if !principal.Can(scope) || !principal.Allows(key(r)) {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+
+		fn(w, r)
 	}
+}
 
-	auth, err := authenticater.NewBasicAuthFromString(s.Credentials)
-	if err != nil {
-		log.Fatalf("server.middleware error=%v", err)
-		return nil
+// Requires credentials granting the admin scope, whatever the
+// authenticated scopes. Admin endpoints are off without credentials.
+func (s *Server) admin(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := s.authenticate(r, nil)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="busl"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if logger, ok := w.(*util.ResponseLogger); ok {
+			logger.SetPrincipal(principal.Name)
+		}
+
+		if !principal.Can(auth.Admin) || !principal.Allows(key(r)) {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// Authenticates client certificates, signed URLs when there's a
+// signing key, bearer JWTs when they're accepted, basic auth against
+// the server's credentials and then the namespace's ones otherwise.
+func (s *Server) authenticate(r *http.Request, ns *namespace.Namespace) (*auth.Principal, bool) {
+	if principal, ok := auth.AuthenticateCertificate(r); ok {
+		return principal, ok
 	}
-	return authenticater.WrapAuth(auth, fn)
+
+	if principal, ok := s.authenticateSignature(r); ok {
+		return principal, ok
+	}
+
+	if s.jwt != nil && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return s.jwt.Authenticate(r)
+	}
+
+	if principal, ok := s.credentials.Authenticate(r); ok {
+		return principal, ok
+	}
+
+	if ns != nil {
+		return ns.Authenticate(r)
+	}
+	return nil, false
 }
 
+func (s *Server) authenticated(scope auth.Scope) bool {
+	scopes := s.AuthenticatedScopes
+	if scopes == nil {
+		scopes = []auth.Scope{auth.Create}
+	}
+
+	for _, authenticated := range scopes {
+		if authenticated == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs every request, and traces it under the
+// span propagated with its `traceparent`, if any.
 func logRequest(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		span := trace.Start(trace.FromRequest(r), "http.request")
+		span.SetAttribute("method", r.Method)
+		span.SetAttribute("route", route(r))
+		r = r.WithContext(trace.NewContext(r.Context(), span.Context))
+
 		logger := util.NewResponseLogger(r, w)
 		fn(logger, r)
 		logger.WriteLog()
+		countResponse(r, logger.Status())
+
+		span.SetAttribute("status", strconv.Itoa(logger.Status()))
+		span.SetAttribute("request_id", logger.RequestID())
+		span.Finish()
+	}
+}
+
+// Returns the span of the request, set up by logRequest.
+func spanContext(r *http.Request) trace.SpanContext {
+	return trace.FromContext(r.Context())
+}
+
+// Returns a context carrying parent, for storage requests traced
+// under it. Stored output outlives its request, so it's not canceled.
+func traceContext(parent trace.SpanContext) context.Context {
+	return trace.NewContext(context.Background(), parent)
+}
+
+// Adds key value pairs to the request's log line.
+func annotate(w http.ResponseWriter, kv ...interface{}) {
+	if logger, ok := w.(*util.ResponseLogger); ok {
+		logger.Annotate(kv...)
 	}
 }
 
 func (s *Server) addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if origin := r.Header.Get("Origin"); origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
-		w.Header().Set("Access-Control-Expose-Headers", "Cache-Control, Content-Type, Expires, Last-Modified")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		s.corsHeaders(w, r)
 		fn(w, r)
 	}
 }
@@ -84,36 +199,105 @@ func offset(r *http.Request) int64 {
 	return int64(n)
 }
 
+// Builds encoder options from the subscriber's `?lines=true`,
+// `?timestamps=true` and `?ansi=strip` parameters.
+func (s *Server) encoderOptions(r *http.Request) (encoders.Options, error) {
+	query := r.URL.Query()
+	lines, _ := strconv.ParseBool(query.Get("lines"))
+	timestamps, _ := strconv.ParseBool(query.Get("timestamps"))
+
+	opts := encoders.Options{
+		Lines:      lines,
+		Flush:      s.LineFlushDuration,
+		Timestamps: timestamps,
+	}
+
+	switch query.Get("ansi") {
+	case "":
+	case "strip":
+		opts.StripANSI = true
+	default:
+		return opts, errInvalidANSI
+	}
+	return opts, nil
+}
+
+// Returns the offset a subscriber should start reading from. An
+// explicit Last-Event-ID: or Range: always wins (e.g. an SSE client
+// reconnecting), otherwise `?since=` or `?tail=` are resolved server
+// side.
+func (s *Server) startOffset(parent trace.SpanContext, r *http.Request) (int64, error) {
+	if r.Header.Get("last-event-id") != "" || r.Header.Get("Range") != "" {
+		return offset(r), nil
+	}
+
+	query := r.URL.Query()
+
+	if val := query.Get("since"); val != "" {
+		return s.sinceOffset(parent, r, val)
+	}
+
+	if val := query.Get("tail"); val != "" {
+		t, err := parseTail(val)
+		if err != nil {
+			return 0, err
+		}
+		return t.offset(parent, key(r), requestURI(r), s.storageBase(key(r)))
+	}
+
+	return offset(r), nil
+}
+
+// Query parameters interpreted by busl itself. These are
+// stripped before the query is handed to the storage backend.
+var reservedParams = []string{"tail", "lines", "timestamps", "since", "ansi", "token", "expires", "sig", "offset", "wait", "max"}
+
 // Given URL:
-//   http://build-output.heroku.com/streams/1/2/3?foo=bar
+//   http://build-output.heroku.com/streams/1/2/3?foo=bar&tail=lines:10
 //
 // Returns:
 //   1/2/3?foo=bar
 func requestURI(r *http.Request) string {
 	res := key(r)
 
-	if r.URL.RawQuery != "" {
-		res += "?" + r.URL.RawQuery
+	if query := storageQuery(r.URL.RawQuery); query != "" {
+		res += "?" + query
 	}
 
 	return res
 }
 
+// Removes reservedParams from a raw query, leaving the
+// rest (e.g. presigned S3 parameters) untouched.
+func storageQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		name := strings.SplitN(param, "=", 2)[0]
+		if !util.StringInSlice(reservedParams, name) {
+			params = append(params, param)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
 func key(r *http.Request) string {
 	return mux.Vars(r)["key"]
 }
 
-// Returns a broker or blob reader.
-func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	// Get the offset from Last-Event-ID: or Range:
-	offset := offset(r)
-
-	rd, err := broker.NewReader(key(r))
+// Returns a broker or blob reader starting at offset.
+func (s *Server) newStorageReader(parent trace.SpanContext, w http.ResponseWriter, r *http.Request, offset int64) (io.ReadCloser, error) {
+	rd, err := broker.NewReaderWithOptions(key(r), broker.IOOptions{TraceParent: parent})
 
 	// Not cached in the broker anymore, try the storage backend as a fallback.
 	if err == broker.ErrNotRegistered {
-		return storage.Get(requestURI(r), s.StorageBaseURL, offset)
+		annotate(w, "source", "storage")
+		return s.newArchiveReader(parent, r, offset)
 	}
+	annotate(w, "source", "broker")
 
 	if offset > 0 {
 		if seeker, ok := rd.(io.Seeker); ok {
@@ -123,8 +307,33 @@ func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.Re
 	return rd, err
 }
 
-func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	rd, err := s.newStorageReader(w, r)
+func (s *Server) newArchiveReader(parent trace.SpanContext, r *http.Request, offset int64) (io.ReadCloser, error) {
+	rd, err := storage.GetContext(traceContext(parent), requestURI(r), s.storageBase(key(r)), offset)
+	if err != nil || !wantsTimestamps(r) {
+		return rd, err
+	}
+
+	timeline, err := fetchTimeline(parent, key(r), s.storageBase(key(r)))
+	if err != nil {
+		util.CountWithData("server.fetchTimeline.error", 1, "err=%s", err.Error())
+	}
+	return &timedArchive{rd, timeline}, nil
+}
+
+func (s *Server) newReader(parent trace.SpanContext, w http.ResponseWriter, r *http.Request, dropped <-chan struct{}) (io.ReadCloser, error) {
+	opts, err := s.encoderOptions(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the offset from Last-Event-ID:, Range: or ?tail=
+	offset, err := s.startOffset(parent, r)
+	if err != nil {
+		return nil, err
+	}
+	annotate(w, "key", key(r), "offset", offset)
+
+	rd, err := s.newStorageReader(parent, w, r, offset)
 	if err != nil {
 		if rd != nil {
 			rd.Close()
@@ -136,33 +345,122 @@ func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadClose
 	// the keepalive ack.
 	ack := []byte{0}
 
-	if broker.NoContent(rd, offset(r)) {
+	if broker.NoContent(rd, offset) {
 		return nil, errNoContent
 	}
 
-	if r.Header.Get("Accept") == "text/event-stream" {
+	encoding := "raw"
+	switch r.Header.Get("Accept") {
+	case "text/event-stream":
+		encoding = "sse"
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 
-		encoder := encoders.NewSSEEncoder(rd)
-		encoder.(io.Seeker).Seek(offset(r), 0)
-
-		rd = ioutil.NopCloser(encoder)
-
 		// For SSE, we change the ack to a :keepalive
 		ack = []byte(":keepalive\n")
+
+	case "application/x-ndjson":
+		encoding = "ndjson"
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		// NDJSON parsers skip blank lines.
+		ack = []byte("\n")
+
+	case "text/html":
+		encoding = "html"
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		// Whitespace doesn't change how the fragments render.
+		ack = []byte("\n")
+	}
+
+	annotate(w, "encoder", encoding)
+
+	policy := slowPolicy{
+		limit: int64(s.SubscriberBuffer),
+		head:  func() (int64, error) { return broker.Size(key(r)) },
+	}
+	if s.SlowSubscriberPolicy == policySkip {
+		policy.skip = func(from int64) (io.Reader, int64, error) {
+			return s.skipAhead(parent, r, from, opts)
+		}
 	}
 
 	done := w.(http.CloseNotifier).CloseNotify()
-	return newKeepAliveReader(rd, ack, s.HeartbeatDuration, done), nil
+	return newKeepAliveReader(s.encode(rd, r, offset, opts), offset, ack, s.HeartbeatDuration, done, dropped, policy), nil
+}
+
+// Returns rd, starting at offset, encoded as asked by the Accept header.
+func (s *Server) encode(rd io.ReadCloser, r *http.Request, offset int64, opts encoders.Options) io.ReadCloser {
+	var encoder encoders.Encoder
+
+	switch r.Header.Get("Accept") {
+	case "text/event-stream":
+		encoder = encoders.NewSSEEncoderWithOptions(rd, opts)
+		encoder.Seek(offset, 0)
+
+		return &statusEvent{Encoder: encoder, load: func() (*completion, error) { return s.loadStatus(r) }}
+
+	case "application/x-ndjson":
+		encoder = encoders.NewNDJSONEncoderWithOptions(rd, opts)
+
+	case "text/html":
+		encoder = encoders.NewHTMLEncoder(rd, opts)
+
+	default:
+		if !opts.StripANSI {
+			return rd
+		}
+		encoder = encoders.NewRawEncoder(rd, opts)
+	}
+
+	encoder.Seek(offset, 0)
+	return encoder
+}
+
+// Reopens the stream of a slow subscriber where its producer is, or
+// at from if it isn't ahead, returning it and the offset it's at.
+func (s *Server) skipAhead(parent trace.SpanContext, r *http.Request, from int64, opts encoders.Options) (io.Reader, int64, error) {
+	head, err := broker.Size(key(r))
+	if err != nil {
+		return nil, from, err
+	}
+	if head < from {
+		head = from
+	}
+
+	rd, err := broker.NewReaderWithOptions(key(r), broker.IOOptions{TraceParent: parent})
+	if err != nil {
+		return nil, from, err
+	}
+	if seeker, ok := rd.(io.Seeker); ok {
+		seeker.Seek(head, 0)
+	}
+	return s.encode(rd, r, head, opts), head, nil
 }
 
-func storeOutput(channel string, requestURI string, storageBase string) {
+func (s *Server) storeOutput(parent trace.SpanContext, channel string, requestURI string, storageBase string) {
+	span := trace.Start(parent, "server.storeOutput")
+	span.SetAttribute("key", channel)
+	defer span.Finish()
+
 	if buf, err := broker.Get(channel); err == nil {
-		if err := storage.Put(requestURI, storageBase, bytes.NewBuffer(buf)); err != nil {
+		span.SetAttribute("bytes", strconv.Itoa(len(buf)))
+		if err := storage.PutContext(traceContext(span.Context), requestURI, storageBase, bytes.NewBuffer(buf)); err != nil {
 			util.CountWithData("server.storeOutput.put.error", 1, "err=%s", err.Error())
+			span.SetError(err)
+			return
 		}
+		storeTimeline(span.Context, channel, storageBase)
+		storeTokens(span.Context, channel, storageBase)
+		storeStatus(span.Context, channel, storageBase)
+
+		location, _ := storage.Location(requestURI, storageBase)
+		s.notify(webhook.Archived, channel, location)
 	} else {
+		span.SetError(err)
 		util.CountWithData("server.storeOutput.get.error", 1, "err=%s", err.Error())
 	}
 }
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/namespace"
+)
+
+// Returns the namespace of key, if any.
+func (s *Server) namespace(key string) *namespace.Namespace {
+	return s.namespaces.Lookup(key)
+}
+
+// Returns the storage base URL of key's namespace,
+// falling back to the server's.
+func (s *Server) storageBase(key string) string {
+	if ns := s.namespace(key); ns != nil && ns.StorageBaseURL != "" {
+		return ns.StorageBaseURL
+	}
+	return s.StorageBaseURL
+}
+
+// Returns the broker options of a new stream, as set by its namespace.
+func (s *Server) brokerOptions(key string) broker.Options {
+	ns := s.namespace(key)
+	if ns == nil {
+		return broker.Options{}
+	}
+	return broker.Options{TTL: ns.TTL.Duration, MaxBytes: ns.MaxStreamBytes}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/trace"
+)
+
+// Long polls wait up to maxPollWait and return up to maxPollBytes,
+// or fewer with `?max=`.
+const (
+	maxPollWait  = time.Minute
+	maxPollBytes = 1 << 20
+)
+
+var (
+	errInvalidOffset = errors.New("Invalid offset parameter.")
+	errInvalidWait   = errors.New("Invalid wait parameter.")
+	errInvalidMax    = errors.New("Invalid max parameter.")
+)
+
+// Headers of long poll responses.
+const (
+	nextOffsetHeader = "Busl-Next-Offset" // to poll from next
+	doneHeader       = "Busl-Done"        // whether the stream was entirely read
+)
+
+// Returns the bytes of a stream from `?offset=` on, waiting up to
+// `?wait=` for some to be published if there are none yet, for
+// clients which can't hold a streaming response.
+func (s *Server) poll(w http.ResponseWriter, r *http.Request) {
+	offset, wait, max, err := pollParams(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	span := trace.Start(spanContext(r), "server.poll")
+	span.SetAttribute("key", key(r))
+	defer span.Finish()
+
+	annotate(w, "key", key(r), "offset", offset, "wait", wait)
+
+	data, done, err := broker.Poll(key(r), offset, max, wait)
+
+	// Not cached in the broker anymore, read the stored output.
+	if err == broker.ErrNotRegistered {
+		annotate(w, "source", "storage")
+		data, done, err = s.pollArchive(span.Context, r, offset, max)
+	} else {
+		annotate(w, "source", "broker")
+	}
+	if err != nil {
+		span.SetError(err)
+		handleError(w, r, err)
+		return
+	}
+	span.SetAttribute("bytes", strconv.Itoa(len(data)))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set(nextOffsetHeader, strconv.FormatInt(offset+int64(len(data)), 10))
+	w.Header().Set(doneHeader, strconv.FormatBool(done))
+	w.Write(data)
+}
+
+// Reads up to max bytes of the stored output from offset on.
+func (s *Server) pollArchive(parent trace.SpanContext, r *http.Request, offset int64, max int) (data []byte, done bool, err error) {
+	rd, err := storage.GetContext(traceContext(parent), requestURI(r), s.storageBase(key(r)), offset)
+	if rd != nil {
+		defer rd.Close()
+	}
+
+	// Nothing is left past the end of the output.
+	if err == storage.ErrRange {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// One more byte tells whether there's more.
+	data, err = ioutil.ReadAll(io.LimitReader(rd, int64(max)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) > max {
+		return data[:max], false, nil
+	}
+	return data, true, nil
+}
+
+func pollParams(r *http.Request) (offset int64, wait time.Duration, max int, err error) {
+	query := r.URL.Query()
+
+	if val := query.Get("offset"); val != "" {
+		if offset, err = strconv.ParseInt(val, 10, 64); err != nil || offset < 0 {
+			return 0, 0, 0, errInvalidOffset
+		}
+	}
+
+	// Durations, or seconds.
+	if wait, err = time.ParseDuration(query.Get("wait")); err != nil {
+		secs, err := strconv.Atoi(query.Get("wait"))
+		if err != nil {
+			return 0, 0, 0, errInvalidWait
+		}
+		wait = time.Duration(secs) * time.Second
+	}
+	if wait < 0 || wait > maxPollWait {
+		return 0, 0, 0, errInvalidWait
+	}
+
+	max = maxPollBytes
+	if val := query.Get("max"); val != "" {
+		if max, err = strconv.Atoi(val); err != nil || max <= 0 || max > maxPollBytes {
+			return 0, 0, 0, errInvalidMax
+		}
+	}
+	return offset, wait, max, nil
+}
+
+// Matches long polls, which have a `?wait=`.
+func hasWait(r *http.Request, _ *mux.RouteMatch) bool {
+	_, ok := r.URL.Query()["wait"]
+	return ok
+}
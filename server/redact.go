@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/redact"
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/webhook"
+)
+
+var errInvalidSecrets = errors.New("Invalid secrets, expected {\"secrets\": [\"...\"]}.")
+
+// Metadata field holding the hashed secrets of a stream.
+const secretsField = "secrets"
+
+// Secrets are registered with a JSON body on PUT. Their size is
+// bounded, so is the body.
+const maxPutBody = 1 << 20
+
+// Reads the literal secrets to redact from a PUT body, if any. Bodies
+// which aren't JSON objects are ignored, as they always have been.
+func readSecrets(r *http.Request) (*redact.Secrets, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPutBody))
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &body); err != nil || body["secrets"] == nil {
+		return nil, nil
+	}
+
+	var secrets []string
+	if err := json.Unmarshal(body["secrets"], &secrets); err != nil {
+		return nil, errInvalidSecrets
+	}
+
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	return redact.NewSecrets(secrets)
+}
+
+func storeSecrets(key string, secrets *redact.Secrets) error {
+	buf, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	return broker.SetMeta(key, secretsField, buf)
+}
+
+func loadSecrets(key string) (*redact.Secrets, error) {
+	buf, err := broker.GetMeta(key, secretsField)
+	if err != nil || buf == nil {
+		return nil, err
+	}
+
+	secrets := &redact.Secrets{}
+	return secrets, json.Unmarshal(buf, secrets)
+}
+
+// Returns a writer to the broker which masks the stream's secrets
+// and the configured patterns out of published data, along with
+// the well known credentials of redact.DefaultPatterns if enabled,
+// throttled to the publish rate limit. Streams already past their
+// rate are refused with a RateLimitError.
+func (s *Server) newWriter(parent trace.SpanContext, key string) (io.WriteCloser, error) {
+	var throttled *throttledWriter
+	if s.PublishRateLimit > 0 {
+		throttled = &throttledWriter{key: key, limit: s.PublishRateLimit}
+		if err := throttled.admit(); err != nil {
+			return nil, err
+		}
+	}
+
+	writer, err := broker.NewWriterWithOptions(key, broker.IOOptions{TraceParent: parent})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.webhooks != nil && broker.Offset(writer) == 0 {
+		writer = &firstByteWriter{WriteCloser: writer, notify: func() {
+			s.notify(webhook.FirstByte, key, "")
+		}}
+	}
+
+	secrets, err := loadSecrets(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []*regexp.Regexp
+	if s.RedactDefaults {
+		patterns = append(patterns, redact.DefaultPatterns...)
+	}
+	patterns = append(patterns, s.RedactPatterns...)
+	redacted := redact.NewWriter(writer, secrets, patterns)
+
+	if throttled != nil {
+		throttled.WriteCloser = redacted
+		return throttled, nil
+	}
+	return redacted, nil
+}
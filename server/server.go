@@ -4,57 +4,160 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/braintree/manners"
 	"github.com/gorilla/mux"
+	"github.com/heroku/busl/auth"
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/metrics"
+	"github.com/heroku/busl/namespace"
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
+	"github.com/heroku/busl/webhook"
 	"github.com/heroku/rollbar"
 )
 
 // Config holds all the server options
 type Config struct {
-	EnforceHTTPS      bool
-	Credentials       string
-	HeartbeatDuration time.Duration
-	StorageBaseURL    string
+	EnforceHTTPS         bool
+	Credentials          string
+	CredentialsFile      string
+	AuthenticatedScopes  []auth.Scope // scopes requiring credentials, create by default
+	JWTSecret            string       // HMAC secret for bearer JWTs
+	JWTKeysFile          string       // PEM or JWKS public keys for bearer JWTs
+	JWTAudience          string       // `aud` required in bearer JWTs
+	NamespacesFile       string       // JSON namespaces, see namespace.Load
+	HeartbeatDuration    time.Duration
+	LineFlushDuration    time.Duration
+	StorageBaseURL       string
+	RedactPatterns       []*regexp.Regexp // masked out of published data
+	RedactDefaults       bool             // also mask redact.DefaultPatterns
+	StreamTokens         bool             // require per stream tokens to publish and subscribe
+	SigningKey           string           // accept signed URLs as credentials to subscribe
+	CreateRateLimit      int              // stream creations per minute per principal or IP, unlimited if 0
+	MaxStreamSubscribers int              // concurrent subscribers per stream, unlimited if 0
+	MaxIPSubscribers     int              // concurrent subscribers per client IP, unlimited if 0
+	PublishRateLimit     int64            // bytes published per second per stream, unlimited if 0
+	TrustedProxies       []*net.IPNet     // proxies whose X-Forwarded-For is honored
+	CORSOrigins          []string         // origins allowed to make credentialed requests, see allowOrigin
+	CORSAllowHeaders     []string         // request headers allowed cross-origin
+	CORSExposeHeaders    []string         // response headers readable cross-origin
+	CORSMaxAge           time.Duration    // how long preflights are cached
+	TLSCertFile          string           // serve HTTPS with this certificate, reloaded on change
+	TLSKeyFile           string           // private key of TLSCertFile
+	TLSClientCAFile      string           // CAs of client certificates accepted as credentials
+	WebhookURLs          []string         // notified of the lifecycle of streams
+	WebhookSecret        string           // HMAC secret signing webhook deliveries
+	SubscriberBuffer     int              // bytes read ahead per subscriber, defaultSubscriberBuffer if 0
+	SlowSubscriberPolicy string           // "disconnect" (the default) or "skip"
 }
 
 // Server is a launchable api listener
 type Server struct {
 	*manners.GracefulServer
 	*Config
+	credentials *auth.Credentials
+	jwt         *auth.JWTVerifier // nil unless JWTs are accepted
+	namespaces  *namespace.Namespaces
+	conns       *connections      // publishers and subscribers connected to this instance
+	sockets     *sockets          // client connections, to cut subscribers off
+	webhooks    *webhook.Notifier // nil unless webhooks are configured
+	background  sync.Once
+	stop        chan struct{} // closed on shutdown, stopping the background work
 }
 
-// NewServer creates a new server instance
+// NewServer creates a new server instance, loading its credentials,
+// JWT keys and namespaces and starting its webhook notifier once:
+// ReloadCredentials rereads the credentials in place.
 func NewServer(config *Config) *Server {
-	return &Server{
+	s := &Server{
 		GracefulServer: manners.NewServer(),
 		Config:         config,
+		conns:          newConnections(),
+		sockets:        newSockets(),
+		stop:           make(chan struct{}),
 	}
+
+	var err error
+	if s.credentials, err = auth.New(s.Credentials, s.CredentialsFile); err != nil {
+		util.Fatal("server.credentials", "error", err)
+	}
+
+	if s.JWTSecret != "" || s.JWTKeysFile != "" {
+		if s.jwt, err = auth.NewJWTVerifier(s.JWTSecret, s.JWTKeysFile, s.JWTAudience); err != nil {
+			util.Fatal("server.jwt", "error", err)
+		}
+	}
+
+	if s.NamespacesFile != "" {
+		if s.namespaces, err = namespace.Load(s.NamespacesFile); err != nil {
+			util.Fatal("server.namespaces", "error", err)
+		}
+	}
+
+	if len(s.WebhookURLs) > 0 {
+		s.webhooks = webhook.New(s.WebhookURLs, s.WebhookSecret)
+	}
+	return s
 }
 
 // Start starts the server instance
 func (s *Server) Start(port string, shutdown <-chan struct{}) {
-	log.Printf("http.start.port=%s\n", port)
+	util.Info("http.start", "port", port)
 	s.Handler = s.router()
+	s.ConnState = s.sockets.track
 	go s.listenForShutdown(shutdown)
 
 	s.Addr = ":" + port
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatalf("server.server error=%v", err)
+	if s.TLSCertFile == "" {
+		if err := s.ListenAndServe(); err != nil {
+			util.Fatal("server.server", "error", err)
+		}
+		return
+	}
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		util.Fatal("server.server", "error", err)
+	}
+	if err := s.serveTLS(listener); err != nil {
+		util.Fatal("server.server", "error", err)
 	}
 }
 
+// ReloadCredentials rereads the credentials, JWT keys and
+// namespaces files, e.g. on SIGHUP.
+func (s *Server) ReloadCredentials() error {
+	if s.credentials != nil {
+		if err := s.credentials.Reload(); err != nil {
+			return err
+		}
+	}
+
+	if s.jwt != nil {
+		if err := s.jwt.Reload(); err != nil {
+			return err
+		}
+	}
+
+	if s.namespaces != nil {
+		return s.namespaces.Reload()
+	}
+	return nil
+}
+
 func (s *Server) listenForShutdown(shutdown <-chan struct{}) {
-	log.Println("http.graceful.await")
+	util.Info("http.graceful.await")
 	<-shutdown
-	log.Println("http.graceful.shutdown")
+	util.Info("http.graceful.shutdown")
 	s.Close()
+	close(s.stop)
 }
 
 func (s *Server) mkstream(w http.ResponseWriter, _ *http.Request) {
@@ -74,20 +177,51 @@ func (s *Server) mkstream(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
+	if err := s.mintTokens(w, uuid); err != nil {
+		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
+		rollbar.Error(rollbar.ERR, fmt.Errorf("unable to mint stream tokens: %#v", err))
+		util.CountWithData("mkstream.create.fail", 1, "error=%s", err)
+		return
+	}
+
 	util.Count("mkstream.create.success")
+	s.notify(webhook.Created, uuid, "")
 	io.WriteString(w, string(uuid))
 }
 
 func (s *Server) put(w http.ResponseWriter, r *http.Request) {
 	registrar := broker.NewRedisRegistrar()
 
-	if err := registrar.Register(key(r)); err != nil {
+	secrets, err := readSecrets(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if err := registrar.RegisterWithOptions(key(r), s.brokerOptions(key(r))); err != nil {
 		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
 		rollbar.Error(rollbar.ERR, fmt.Errorf("unable to register stream: %#v", err))
 		util.CountWithData("put.create.fail", 1, "error=%s", err)
 		return
 	}
+
+	if secrets != nil {
+		if err := storeSecrets(key(r), secrets); err != nil {
+			http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
+			rollbar.Error(rollbar.ERR, fmt.Errorf("unable to store secrets: %#v", err))
+			util.CountWithData("put.create.fail", 1, "error=%s", err)
+			return
+		}
+	}
+	if err := s.mintTokens(w, key(r)); err != nil {
+		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
+		rollbar.Error(rollbar.ERR, fmt.Errorf("unable to mint stream tokens: %#v", err))
+		util.CountWithData("put.create.fail", 1, "error=%s", err)
+		return
+	}
+
 	util.Count("put.create.success")
+	s.notify(webhook.Created, key(r), "")
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -96,28 +230,97 @@ func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) pub(w http.ResponseWriter, r *http.Request) {
-	if !util.StringInSlice(r.TransferEncoding, "chunked") {
+	// HTTP/2 streams request bodies without a Transfer-Encoding.
+	if r.ProtoMajor < 2 && !util.StringInSlice(r.TransferEncoding, "chunked") {
 		http.Error(w, "A chunked Transfer-Encoding header is required.", http.StatusBadRequest)
 		return
 	}
 
-	writer, err := broker.NewWriter(key(r))
+	span := trace.Start(spanContext(r), "server.pub")
+	span.SetAttribute("key", key(r))
+	defer span.Finish()
+
+	writer, err := s.newWriter(span.Context, key(r))
+	if _, ok := err.(*broker.RateLimitError); ok {
+		util.CountWithData("server.limit.publish", 1, "key=%s", key(r))
+	}
 	if err != nil {
+		span.SetError(err)
 		handleError(w, r, err)
 		return
 	}
-	defer writer.Close()
+
+	publishers.Inc()
+	defer publishers.Dec()
+
+	dropped, untrack := s.conns.track("publisher", r, s.clientIP(r))
+	defer untrack()
+
+	// Dropped publishers are cut off at once rather than on their next write.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-dropped:
+			s.sockets.setReadDeadline(r, time.Now())
+		case <-finished:
+		}
+	}()
 
 	body := bufio.NewReader(r.Body)
 	defer r.Body.Close()
 
-	_, err = io.Copy(writer, body)
+	n, err := io.Copy(writer, body)
+	select {
+	case <-dropped:
+		util.CountWithData("server.pub.dropped", 1, "key=%s", key(r))
+		err = nil
+	default:
+	}
+	publishedBytes.Add(float64(n))
+	annotate(w, "key", key(r), "bytes_received", n)
+	span.SetAttribute("bytes", strconv.FormatInt(n, 10))
+
+	// Publishers may say how the stream ended in trailers, which
+	// are stored before closing so subscribers find them when done.
+	// An invalid status is left out with a warning rather than
+	// failing what was published, which is stored all the same.
+	if err == nil {
+		status, statusErr := trailerCompletion(r.Trailer)
+		if statusErr != nil {
+			util.CountWithData("server.pub.status.invalid", 1, "key=%s", key(r))
+			annotate(w, "status_error", statusErr.Error())
+			w.Header().Set("Warning", fmt.Sprintf("199 busl %q", statusErr.Error()))
+		}
+		if status != nil {
+			err = storeCompletion(key(r), status)
+		}
+	}
+
+	// Closing flushes what was held back for redaction, which
+	// needs to reach the broker before the output is stored.
+	cerr := writer.Close()
+	if cerr == nil {
+		s.notify(webhook.Completed, key(r), "")
+	}
+	if err == nil {
+		err = cerr
+	}
+	span.SetError(err)
 
 	if err == io.ErrUnexpectedEOF {
 		util.CountWithData("server.pub.read.eoferror", 1, "msg=\"%v\"", err.Error())
 		return
 	}
 
+	if err == broker.ErrQuotaExceeded {
+		// What fit in the quota is stored all the same.
+		util.CountWithData("server.pub.quota", 1, "key=%s", key(r))
+		go s.storeOutput(span.Context, key(r), requestURI(r), s.storageBase(key(r)))
+		handleError(w, r, err)
+		return
+	}
+
 	netErr, ok := err.(net.Error)
 	if ok && netErr.Timeout() {
 		util.CountWithData("server.pub.read.timeout", 1, "msg=\"%v\"", err.Error())
@@ -126,14 +329,14 @@ func (s *Server) pub(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		log.Printf("%#v", err)
+		util.Error("server.pub", "key", key(r), "error", fmt.Sprintf("%#v", err))
 		http.Error(w, "Unhandled error, please try again.", http.StatusInternalServerError)
 		rollbar.Error(rollbar.ERR, fmt.Errorf("unhandled error: %#v", err))
 		return
 	}
 
 	// Asynchronously upload the output to our defined storage backend.
-	go storeOutput(key(r), requestURI(r), s.StorageBaseURL)
+	go s.storeOutput(span.Context, key(r), requestURI(r), s.storageBase(key(r)))
 }
 
 func (s *Server) sub(w http.ResponseWriter, r *http.Request) {
@@ -142,15 +345,47 @@ func (s *Server) sub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rd, err := s.newReader(w, r)
+	span := trace.Start(spanContext(r), "server.sub")
+	span.SetAttribute("key", key(r))
+	defer span.Finish()
+
+	dropped, untrack := s.conns.track("subscriber", r, s.clientIP(r))
+	defer untrack()
+
+	rd, err := s.newReader(span.Context, w, r, dropped)
 	if rd != nil {
 		defer rd.Close()
 	}
 	if err != nil {
+		span.SetError(err)
 		handleError(w, r, err)
 		return
 	}
-	_, err = io.Copy(newWriteFlusher(w), rd)
+	declareTrailers(w)
+
+	// Subscribers skipping ahead which don't even catch up with what
+	// was read ahead for them are cut off rather than pinning their
+	// connection. Those disconnected get their trailers.
+	if ka, ok := rd.(*keepAliveReader); ok {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-ka.Stalled():
+				util.CountWithData("server.sub.stalled", 1, "key=%s", key(r))
+				s.sockets.setWriteDeadline(r, time.Now())
+			case <-finished:
+			}
+		}()
+	}
+
+	subscribers.Inc()
+	n, err := io.Copy(newWriteFlusher(w), rd)
+	subscribers.Dec()
+	s.setTrailers(w, r, rd, dropped, err)
+	deliveredBytes.Add(float64(n))
+	span.SetAttribute("bytes", strconv.FormatInt(n, 10))
+	span.SetError(err)
 
 	netErr, ok := err.(net.Error)
 	if ok && netErr.Timeout() {
@@ -164,18 +399,41 @@ func (s *Server) sub(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) router() http.Handler {
+	s.background.Do(func() {
+		s.conns.run(s.stop)
+		go s.runSweeps()
+	})
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/health", s.addDefaultHeaders(s.health))
+	r.HandleFunc("/metrics", s.admin(metrics.Handler().ServeHTTP))
+
+	// Live streams and connections, across the fleet.
+	r.HandleFunc("/admin/streams", s.admin(s.adminStreams)).Methods("GET")
+	r.HandleFunc("/admin/streams/{key:.+}", s.admin(s.adminStream)).Methods("GET")
+	r.HandleFunc("/admin/streams/{key:.+}", s.admin(s.adminClose)).Methods("DELETE")
+	r.HandleFunc("/admin/connections/{id}", s.admin(s.adminDisconnect)).Methods("DELETE")
+
+	// CORS preflights, which come without credentials.
+	r.HandleFunc("/streams", s.preflight).Methods("OPTIONS")
+	r.HandleFunc("/streams/{key:.+}", s.preflight).Methods("OPTIONS")
+
+	// Listing streams by prefix. Without one, GET still creates a
+	// stream as the legacy endpoint below always has.
+	r.HandleFunc("/streams", s.addDefaultHeaders(s.listAuth(s.list))).Methods("GET").MatcherFunc(hasPrefix)
 
 	// Legacy endpoint for creating the uuid `key` for you.
-	r.HandleFunc("/streams", s.auth(s.addDefaultHeaders(s.mkstream)))
+	r.HandleFunc("/streams", s.addDefaultHeaders(s.auth(auth.Create, s.limitCreates(s.mkstream))))
 
 	// New `key` design for allowing any kind of id to be decided
 	// by the caller (in this case, it mirrors what we have in S3).
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.sub)).Methods("GET")
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.pub)).Methods("POST")
-	r.HandleFunc("/streams/{key:.+}", s.auth(s.addDefaultHeaders(s.put))).Methods("PUT")
+	// Subscribers which can't hold a streaming response long poll.
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(rejectSidecars(s.auth(auth.Subscribe, s.streamAuth(false, s.limitSubscribers(s.poll)))))).Methods("GET").MatcherFunc(hasWait)
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(rejectSidecars(s.auth(auth.Subscribe, s.streamAuth(false, s.limitSubscribers(s.sub)))))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(rejectSidecars(s.auth(auth.Publish, s.streamAuth(true, s.pub))))).Methods("POST")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(rejectSidecars(s.auth(auth.Create, s.limitCreates(s.put))))).Methods("PUT")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(rejectSidecars(s.auth(auth.Delete, s.streamAuth(true, s.closeStream))))).Methods("DELETE")
 
 	return logRequest(s.enforceHTTPS(r.ServeHTTP))
 }
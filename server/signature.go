@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heroku/busl/auth"
+)
+
+// Sign returns the signature of a subscribe URL for key which is
+// valid until expires, to be used as
+//
+//   /streams/{key}?expires={expires.Unix()}&sig={signature}
+//
+// signingKey is the server's Config.SigningKey.
+func Sign(signingKey string, key string, expires time.Time) string {
+	return signature(signingKey, key, strconv.FormatInt(expires.Unix(), 10))
+}
+
+func signature(signingKey string, key string, expires string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(key + ":" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticates a signed URL as a subscriber of its key only, checking
+// `?expires=` and `?sig=` without any broker or storage lookup. Only
+// the routes of a stream accept them.
+func (s *Server) authenticateSignature(r *http.Request) (*auth.Principal, bool) {
+	query := r.URL.Query()
+	key, ok := mux.Vars(r)["key"]
+	if s.SigningKey == "" || query.Get("sig") == "" || !ok {
+		return nil, false
+	}
+
+	expires := query.Get("expires")
+	ts, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > ts {
+		return nil, false
+	}
+
+	expected := signature(s.SigningKey, key, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		return nil, false
+	}
+	return &auth.Principal{Name: "signed", Scopes: []auth.Scope{auth.Subscribe}, Prefixes: []string{key}}, true
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sockets keeps the connections of the server's clients by their
+// remote address, so publishers and subscribers can be cut off
+// while their requests are blocked reading or writing.
+type sockets struct {
+	sync.Mutex
+	conns map[string]net.Conn
+}
+
+func newSockets() *sockets {
+	return &sockets{conns: make(map[string]net.Conn)}
+}
+
+// track is the server's ConnState hook.
+func (s *sockets) track(conn net.Conn, state http.ConnState) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch state {
+	case http.StateNew:
+		s.conns[conn.RemoteAddr().String()] = conn
+	case http.StateHijacked, http.StateClosed:
+		delete(s.conns, conn.RemoteAddr().String())
+	}
+}
+
+func (s *sockets) conn(r *http.Request) net.Conn {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.conns[r.RemoteAddr]
+}
+
+// setReadDeadline sets the read deadline of the connection
+// a request came in on, if it's tracked.
+func (s *sockets) setReadDeadline(r *http.Request, t time.Time) {
+	if conn := s.conn(r); conn != nil {
+		conn.SetReadDeadline(t)
+	}
+}
+
+// setWriteDeadline sets the write deadline of the connection
+// a request came in on, if it's tracked.
+func (s *sockets) setWriteDeadline(r *http.Request, t time.Time) {
+	if conn := s.conn(r); conn != nil {
+		conn.SetWriteDeadline(t)
+	}
+}
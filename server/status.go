@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/encoders"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/util"
+	"github.com/heroku/busl/webhook"
+)
+
+var errInvalidStatus = errors.New("Invalid status, expected {\"state\": \"success\" or \"failure\", \"exit_code\": 0, \"reason\": \"...\", \"meta\": {...}}.")
+
+// Metadata field holding how a stream completed.
+const statusField = "status"
+
+// Statuses are small JSON documents of at most maxStatusSize bytes.
+const maxStatusSize = 4 << 10
+
+// Completion states.
+const (
+	stateSuccess = "success"
+	stateFailure = "failure"
+)
+
+// completion is how the producer of a stream said it ended, e.g.
+// with the exit code of the command whose output it is.
+type completion struct {
+	State    string          `json:"state"`
+	ExitCode *int            `json:"exit_code,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+}
+
+// Parses a JSON status. Without a state, it's told by the exit code.
+func parseCompletion(buf []byte) (*completion, error) {
+	if len(buf) > maxStatusSize {
+		return nil, errInvalidStatus
+	}
+
+	c := &completion{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, errInvalidStatus
+	}
+
+	if c.State == "" && c.ExitCode != nil {
+		c.State = stateSuccess
+		if *c.ExitCode != 0 {
+			c.State = stateFailure
+		}
+	}
+	if c.State != stateSuccess && c.State != stateFailure {
+		return nil, errInvalidStatus
+	}
+	return c, nil
+}
+
+// Reads the status of a stream from a request body, if any.
+func readCompletion(r *http.Request) (*completion, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxStatusSize+1))
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+	return parseCompletion(buf)
+}
+
+func storeCompletion(key string, c *completion) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return broker.SetMeta(key, statusField, buf)
+}
+
+func loadCompletion(key string) (*completion, error) {
+	buf, err := broker.GetMeta(key, statusField)
+	if err != nil || buf == nil {
+		return nil, err
+	}
+
+	c := &completion{}
+	return c, json.Unmarshal(buf, c)
+}
+
+// Loads the status of a stream from the broker, or from its archive
+// once it expired there. Streams without a status return nil.
+func (s *Server) loadStatus(r *http.Request) (*completion, error) {
+	buf, err := broker.GetMeta(key(r), statusField)
+	if err != nil {
+		return nil, err
+	}
+
+	if buf == nil && !broker.NewRedisRegistrar().IsRegistered(key(r)) {
+		buf, err = fetchStatus(spanContext(r), key(r), s.storageBase(key(r)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if buf == nil {
+		return nil, nil
+	}
+
+	c := &completion{}
+	return c, json.Unmarshal(buf, c)
+}
+
+// The status is archived next to the output like
+// the timeline, i.e. 1/2/3 goes to 1/2/3.status
+func storeStatus(parent trace.SpanContext, channel string, storageBase string) {
+	buf, err := broker.GetMeta(channel, statusField)
+	if err != nil {
+		util.CountWithData("server.storeStatus.get.error", 1, "err=%s", err.Error())
+		return
+	}
+
+	if buf == nil {
+		return
+	}
+
+	if err := storage.PutContext(traceContext(parent), sidecarURI(channel, ".status"), storageBase, bytes.NewBuffer(buf)); err != nil {
+		util.CountWithData("server.storeStatus.put.error", 1, "err=%s", err.Error())
+	}
+}
+
+func fetchStatus(parent trace.SpanContext, key string, storageBase string) ([]byte, error) {
+	rd, err := storage.GetContext(traceContext(parent), sidecarURI(key, ".status"), storageBase, 0)
+	if rd != nil {
+		defer rd.Close()
+	}
+
+	switch err {
+	case nil:
+		return ioutil.ReadAll(io.LimitReader(rd, maxStatusSize))
+	case storage.ErrNotFound, storage.ErrNoStorage:
+		return nil, nil
+	}
+	return nil, err
+}
+
+// Closes a stream as its publisher would, with the status
+// in the body if any, and disconnects its publishers.
+func (s *Server) closeStream(w http.ResponseWriter, r *http.Request) {
+	status, err := readCompletion(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if !broker.NewRedisRegistrar().IsRegistered(key(r)) {
+		handleError(w, r, broker.ErrNotRegistered)
+		return
+	}
+
+	if status != nil {
+		if err := storeCompletion(key(r), status); err != nil {
+			handleError(w, r, err)
+			return
+		}
+	}
+
+	if err := broker.CloseStream(key(r)); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	s.notify(webhook.Completed, key(r), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statusEvent ends an SSE stream with its status, if the
+// producer gave one, as an `event: status` once it's done.
+type statusEvent struct {
+	encoders.Encoder
+	load  func() (*completion, error)
+	event []byte
+	done  bool
+}
+
+func (e *statusEvent) Read(p []byte) (int, error) {
+	if !e.done {
+		n, err := e.Encoder.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		e.done = true
+		if status, _ := e.load(); status != nil {
+			buf, _ := json.Marshal(status)
+			e.event = encoders.SSEEvent("status", buf)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	if len(e.event) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, e.event)
+	e.event = e.event[n:]
+	return n, nil
+}
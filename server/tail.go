@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/trace"
+)
+
+var errInvalidTail = errors.New("Invalid tail parameter.")
+
+// Up to maxTailLines lines can be tailed.
+const maxTailLines = 1 << 20
+
+// tail describes a `?tail=lines:N` or `?tail=bytes:N` request, i.e.
+// start streaming from the last N lines or bytes of a stream.
+type tail struct {
+	lines bool
+	n     int64
+}
+
+func parseTail(val string) (*tail, error) {
+	tuple := strings.SplitN(val, ":", 2)
+	if len(tuple) != 2 || (tuple[0] != "lines" && tuple[0] != "bytes") {
+		return nil, errInvalidTail
+	}
+
+	n, err := strconv.ParseInt(tuple[1], 10, 64)
+	if err != nil || n < 0 {
+		return nil, errInvalidTail
+	}
+
+	lines := tuple[0] == "lines"
+	if lines && n > maxTailLines {
+		return nil, errInvalidTail
+	}
+	return &tail{lines: lines, n: n}, nil
+}
+
+// Resolves the tail against the broker, falling back to
+// scanning the stored output when the stream has expired.
+func (t *tail) offset(parent trace.SpanContext, key, requestURI, storageBase string) (int64, error) {
+	var (
+		off int64
+		err error
+	)
+
+	if t.lines {
+		off, err = broker.LineOffset(key, t.n)
+	} else {
+		off, err = broker.Size(key)
+		off -= t.n
+	}
+
+	if err == broker.ErrNotRegistered {
+		off, err = t.storageOffset(parent, requestURI, storageBase)
+	}
+
+	if off < 0 {
+		off = 0
+	}
+	return off, err
+}
+
+func (t *tail) storageOffset(parent trace.SpanContext, requestURI, storageBase string) (int64, error) {
+	if !t.lines {
+		size, err := storage.Size(traceContext(parent), requestURI, storageBase)
+		return size - t.n, err
+	}
+
+	rd, err := storage.GetContext(traceContext(parent), requestURI, storageBase, 0)
+	if err != nil {
+		if rd != nil {
+			rd.Close()
+		}
+		return 0, err
+	}
+	defer rd.Close()
+
+	return t.scan(rd)
+}
+
+// Reads rd to the end, remembering the positions of the last
+// n+1 newlines to work out where the tail of lines starts.
+func (t *tail) scan(rd io.Reader) (int64, error) {
+	var (
+		size      int64
+		newlines  []int64
+		remaining = t.n + 1
+	)
+
+	br := bufio.NewReader(rd)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if b == '\n' {
+			if remaining > 0 {
+				remaining--
+			} else {
+				newlines = newlines[1:]
+			}
+			newlines = append(newlines, size)
+		}
+		size++
+	}
+
+	// A trailing newline terminates the last line.
+	if l := len(newlines); l > 0 && newlines[l-1] == size-1 {
+		newlines = newlines[:l-1]
+	}
+
+	if t.n == 0 {
+		return size, nil
+	}
+	if int64(len(newlines)) < t.n {
+		return 0, nil
+	}
+	return newlines[int64(len(newlines))-t.n] + 1, nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/encoders"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/util"
+)
+
+var (
+	errInvalidSince = errors.New("Invalid since parameter.")
+	errReservedKey  = errors.New("Keys can't end with .times, .tokens or .status.")
+)
+
+// Extensions of the sidecar files, which keys can't end with.
+var sidecarExts = []string{".times", ".tokens", ".status"}
+
+// Sidecar files are archived next to a stream's output under the
+// storage base, e.g. 1/2/3 has 1/2/3.times. They're located by key
+// alone, as a presigned query is only valid for the output itself.
+func sidecarURI(key string, ext string) string {
+	return key + ext
+}
+
+// Rejects keys which would be served the sidecar files of others.
+func rejectSidecars(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, ext := range sidecarExts {
+			if strings.HasSuffix(key(r), ext) {
+				handleError(w, r, errReservedKey)
+				return
+			}
+		}
+		fn(w, r)
+	}
+}
+
+// The timeline of a stream is archived next to
+// its output, i.e. 1/2/3 goes to 1/2/3.times
+func timelineURI(key string) string {
+	return sidecarURI(key, ".times")
+}
+
+func storeTimeline(parent trace.SpanContext, channel string, storageBase string) {
+	buf, err := broker.GetTimeline(channel)
+	if err != nil {
+		util.CountWithData("server.storeTimeline.get.error", 1, "err=%s", err.Error())
+		return
+	}
+
+	if len(buf) == 0 {
+		return
+	}
+
+	if err := storage.PutContext(traceContext(parent), timelineURI(channel), storageBase, bytes.NewBuffer(buf)); err != nil {
+		util.CountWithData("server.storeTimeline.put.error", 1, "err=%s", err.Error())
+	}
+}
+
+// Fetches the archived timeline of a stream. Streams archived
+// without one simply have an empty timeline.
+func fetchTimeline(parent trace.SpanContext, key string, storageBase string) (broker.Timeline, error) {
+	rd, err := storage.GetContext(traceContext(parent), timelineURI(key), storageBase, 0)
+	if rd != nil {
+		defer rd.Close()
+	}
+
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadAll(rd)
+	return broker.ParseTimeline(buf), err
+}
+
+// Resolves `?since=` against the broker, falling back to the
+// archived timeline when the stream has expired.
+func (s *Server) sinceOffset(parent trace.SpanContext, r *http.Request, val string) (int64, error) {
+	ts, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return 0, errInvalidSince
+	}
+
+	offset, err := broker.SinceOffset(key(r), ts)
+	if err != broker.ErrNotRegistered {
+		return offset, err
+	}
+
+	timeline, err := fetchTimeline(parent, key(r), s.storageBase(key(r)))
+	if err != nil || len(timeline) == 0 {
+		return 0, err
+	}
+
+	offset, ok := timeline.Since(ts)
+	if !ok {
+		// Archived streams are complete: nothing else will come.
+		return 0, errNoContent
+	}
+	return offset, nil
+}
+
+// Whether the subscriber will get write times, i.e. NDJSON
+// records or SSE events with `?timestamps=true`.
+func wantsTimestamps(r *http.Request) bool {
+	switch r.Header.Get("Accept") {
+	case "application/x-ndjson":
+		return true
+	case "text/event-stream":
+		ok, _ := strconv.ParseBool(r.URL.Query().Get("timestamps"))
+		return ok
+	}
+	return false
+}
+
+// timedArchive adds the archived timeline to stored output.
+type timedArchive struct {
+	io.ReadCloser
+	timeline broker.Timeline
+}
+
+func (a *timedArchive) State() string {
+	if stater, ok := a.ReadCloser.(encoders.Stater); ok {
+		return stater.State()
+	}
+	return ""
+}
+
+func (a *timedArchive) Timestamp(offset int64) (time.Time, bool) {
+	return a.timeline.At(offset)
+}
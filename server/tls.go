@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+var errNoClientCAs = errors.New("No certificates found in the client CA file.")
+
+// certificate is a TLS certificate reloaded
+// whenever its files change, e.g. on renewal.
+type certificate struct {
+	sync.Mutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+	modTime           time.Time
+}
+
+func newCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+// Returns the files' latest modification time.
+func (c *certificate) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certificate) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// get is a tls.Config GetCertificate callback. The certificate in
+// use is kept if the files are unreadable, e.g. halfway through
+// being replaced.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if modTime, err := c.lastModified(); err == nil && !modTime.Equal(c.modTime) {
+		if err := c.reload(); err != nil {
+			util.CountWithData("server.tls.reload.error", 1, "error=%s", err)
+		} else {
+			util.Count("server.tls.reload")
+		}
+	}
+	return c.cert, nil
+}
+
+// Builds the TLS configuration from TLSCertFile and TLSKeyFile,
+// negotiating HTTP/2. With TLSClientCAFile, clients may present a
+// certificate signed by one of its CAs to authenticate.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cert, err := newCertificate(s.TLSCertFile, s.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate: cert.get,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if s.TLSClientCAFile != "" {
+		buf, err := ioutil.ReadFile(s.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(buf) {
+			return nil, errNoClientCAs
+		}
+
+		// Subscribers don't need certificates,
+		// they authenticate by other means.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// Serves HTTPS (and HTTP/2) on l.
+func (s *Server) serveTLS(l net.Listener) error {
+	config, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	s.TLSConfig = config
+	return s.Serve(tls.NewListener(l, config))
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/util"
+)
+
+var errInvalidToken = errors.New("A valid stream token is required.")
+
+// Metadata field holding the hashed tokens of a stream.
+const tokensField = "tokens"
+
+// streamTokens holds the SHA-256 digests of a stream's tokens. The
+// write token allows publishing and subscribing, the read token only
+// subscribing.
+type streamTokens struct {
+	Read  string `json:"read"`
+	Write string `json:"write"`
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks a presented token against the stream's tokens.
+func (t *streamTokens) allows(token string, write bool) bool {
+	if t == nil || token == "" {
+		return false
+	}
+
+	digest := []byte(hashToken(token))
+	if subtle.ConstantTimeCompare(digest, []byte(t.Write)) == 1 {
+		return true
+	}
+	return !write && subtle.ConstantTimeCompare(digest, []byte(t.Read)) == 1
+}
+
+// Mints the read and write tokens of a newly registered stream.
+// Only their digests are kept, the tokens themselves are handed
+// out once in the Busl-Read-Token and Busl-Write-Token headers.
+func (s *Server) mintTokens(w http.ResponseWriter, key string) error {
+	if !s.StreamTokens {
+		return nil
+	}
+
+	read, err := newToken()
+	if err != nil {
+		return err
+	}
+	write, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	buf, _ := json.Marshal(&streamTokens{Read: hashToken(read), Write: hashToken(write)})
+	if err := broker.SetMeta(key, tokensField, buf); err != nil {
+		return err
+	}
+
+	w.Header().Set("Busl-Read-Token", read)
+	w.Header().Set("Busl-Write-Token", write)
+	return nil
+}
+
+// Returns the token presented as `Busl-Token: <token>` or with
+// `?token=<token>`, leaving Authorization to credentials and JWTs.
+func presentedToken(r *http.Request) string {
+	if token := r.Header.Get("Busl-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Loads the tokens of a stream from the broker, or from its archive
+// once it expired there. Streams without tokens return nil.
+func (s *Server) loadTokens(r *http.Request) (*streamTokens, error) {
+	buf, err := broker.GetMeta(key(r), tokensField)
+	if err != nil {
+		return nil, err
+	}
+
+	if buf == nil && !broker.NewRedisRegistrar().IsRegistered(key(r)) {
+		buf, err = fetchTokens(spanContext(r), key(r), s.storageBase(key(r)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if buf == nil {
+		return nil, nil
+	}
+
+	tokens := &streamTokens{}
+	return tokens, json.Unmarshal(buf, tokens)
+}
+
+// Whether a request authenticates with the admin scope.
+func (s *Server) isAdmin(r *http.Request) bool {
+	principal, ok := s.authenticate(r, nil)
+	return ok && principal.Can(auth.Admin)
+}
+
+// Wraps fn so it's only served to requests presenting a token of the
+// stream: the write token when write is set, either token otherwise.
+// Streams without tokens (e.g. registered before tokens were enabled,
+// or archived without them) are left to admins, so they're never
+// locked out for good.
+//
+// Subscribers may present a signed URL instead.
+func (s *Server) streamAuth(write bool, fn http.HandlerFunc) http.HandlerFunc {
+	if !s.StreamTokens {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.authenticateSignature(r); ok && !write {
+			fn(w, r)
+			return
+		}
+
+		tokens, err := s.loadTokens(r)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+
+		if tokens == nil && s.isAdmin(r) {
+			fn(w, r)
+			return
+		}
+
+		if !tokens.allows(presentedToken(r), write) {
+			handleError(w, r, errInvalidToken)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// The token digests are archived next to the output like
+// the timeline, i.e. 1/2/3 goes to 1/2/3.tokens
+func storeTokens(parent trace.SpanContext, channel string, storageBase string) {
+	buf, err := broker.GetMeta(channel, tokensField)
+	if err != nil {
+		util.CountWithData("server.storeTokens.get.error", 1, "err=%s", err.Error())
+		return
+	}
+
+	if buf == nil {
+		return
+	}
+
+	if err := storage.PutContext(traceContext(parent), sidecarURI(channel, ".tokens"), storageBase, bytes.NewBuffer(buf)); err != nil {
+		util.CountWithData("server.storeTokens.put.error", 1, "err=%s", err.Error())
+	}
+}
+
+func fetchTokens(parent trace.SpanContext, key string, storageBase string) ([]byte, error) {
+	rd, err := storage.GetContext(traceContext(parent), sidecarURI(key, ".tokens"), storageBase, 0)
+	if rd != nil {
+		defer rd.Close()
+	}
+
+	switch err {
+	case nil:
+		return ioutil.ReadAll(rd)
+	case storage.ErrNotFound, storage.ErrNoStorage:
+		return nil, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Trailers telling how a stream or subscription ended.
+const (
+	statusTrailer      = "Busl-Status"       // JSON status, from publishers
+	exitStatusTrailer  = "Busl-Exit-Status"  // exit code, from and to subscribers
+	streamStateTrailer = "Busl-Stream-State" // done, dropped, slow or error
+	finalOffsetTrailer = "Busl-Final-Offset" // where the subscriber can resume
+	skippedTrailer     = "Busl-Skipped"      // bytes skipped for a slow subscriber
+)
+
+// Subscription states, as told by the Busl-Stream-State trailer.
+const (
+	subscriptionDone    = "done"    // the stream was entirely sent
+	subscriptionDropped = "dropped" // the subscriber was disconnected
+	subscriptionSlow    = "slow"    // the subscriber fell too far behind
+	subscriptionError   = "error"   // reading or sending the stream failed
+)
+
+// Returns the status given by a publisher in its trailers, if any:
+// the whole status or just the exit code.
+func trailerCompletion(trailer http.Header) (*completion, error) {
+	if val := trailer.Get(statusTrailer); val != "" {
+		return parseCompletion([]byte(val))
+	}
+
+	if val := trailer.Get(exitStatusTrailer); val != "" {
+		code, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errInvalidStatus
+		}
+		buf, _ := json.Marshal(completion{ExitCode: &code})
+		return parseCompletion(buf)
+	}
+	return nil, nil
+}
+
+// Declares the trailers of a subscription, which
+// have to be known before its body is sent.
+func declareTrailers(w http.ResponseWriter) {
+	w.Header().Set("Trailer", strings.Join([]string{streamStateTrailer, finalOffsetTrailer, skippedTrailer, exitStatusTrailer}, ", "))
+}
+
+// Sets the trailers of a subscription once its body was sent: how it
+// ended, the offset it can be resumed from, how much of the stream
+// was skipped if any and the exit code of the stream if its publisher
+// gave one.
+func (s *Server) setTrailers(w http.ResponseWriter, r *http.Request, rd io.Reader, dropped <-chan struct{}, err error) {
+	state := subscriptionDone
+	select {
+	case <-dropped:
+		state = subscriptionDropped
+	default:
+	}
+	ka, ok := rd.(*keepAliveReader)
+	if ok && ka.Slow() {
+		state = subscriptionSlow
+	}
+	if err != nil {
+		state = subscriptionError
+	}
+
+	h := w.Header()
+	h.Set(streamStateTrailer, state)
+	if ok {
+		h.Set(finalOffsetTrailer, strconv.FormatInt(ka.Offset(), 10))
+		if skipped := ka.Skipped(); skipped > 0 {
+			h.Set(skippedTrailer, strconv.FormatInt(skipped, 10))
+		}
+	}
+
+	if state != subscriptionDone {
+		return
+	}
+	if status, _ := s.loadStatus(r); status != nil && status.ExitCode != nil {
+		h.Set(exitStatusTrailer, strconv.Itoa(*status.ExitCode))
+	}
+}
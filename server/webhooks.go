@@ -0,0 +1,64 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+	"github.com/heroku/busl/webhook"
+)
+
+// Every instance sweeps the broker for streams which
+// expired every sweepInterval.
+var sweepInterval = time.Minute
+
+// Sends a lifecycle event of the stream key, along with its
+// current size, to the webhooks if there are any.
+func (s *Server) notify(event, key, location string) {
+	if s.webhooks == nil {
+		return
+	}
+
+	size, _ := broker.Size(key)
+	s.webhooks.Notify(webhook.Event{Event: event, Key: key, Bytes: size, Location: location})
+}
+
+// Forgets the streams which expired, notifying the webhooks.
+func (s *Server) sweep() error {
+	expired, err := broker.Sweep()
+	for _, key := range expired {
+		s.notify(webhook.Expired, key, "")
+	}
+	return err
+}
+
+func (s *Server) runSweeps() {
+	for {
+		if err := s.sweep(); err != nil {
+			util.CountWithData("server.sweep.error", 1, "error=%q", err)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(sweepInterval):
+		}
+	}
+}
+
+// firstByteWriter calls notify once the first
+// byte of an empty stream was written.
+type firstByteWriter struct {
+	io.WriteCloser
+	notify func()
+	once   sync.Once
+}
+
+func (w *firstByteWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.once.Do(w.notify)
+	}
+	return n, err
+}
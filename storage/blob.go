@@ -1,24 +1,37 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/heroku/busl/metrics"
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
 )
 
 // Number of times we should retry a failed HTTP request.
 const retries = 3
 
+var (
+	requests       = metrics.NewCounter("busl_storage_requests_total", "Storage requests, by method and result.", "method", "result")
+	requestLatency = metrics.NewHistogram("busl_storage_request_duration_seconds", "Storage request latencies, by method.", "method")
+)
+
 // storage errors
 var (
 	ErrNoStorage = errors.New("No storage defined")
 	ErrNotFound  = errors.New("HTTP 404")
 	ErrRange     = errors.New("HTTP 416: Invalid Range")
 	Err5xx       = errors.New("HTTP 5xx")
+
+	errUnknownSize = errors.New("Unknown size of stored output")
 )
 
 // Put stores the given reader onto the underlying blob storage
@@ -33,9 +46,15 @@ var (
 //   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
 //   err := storage.Put(requestURI, reader)
 //
-func Put(requestURI, baseURI string, reader io.Reader) (err error) {
+func Put(requestURI, baseURI string, reader io.Reader) error {
+	return PutContext(context.Background(), requestURI, baseURI, reader)
+}
+
+// PutContext is Put with requests made with ctx, and traced
+// under the span it carries, if any.
+func PutContext(ctx context.Context, requestURI, baseURI string, reader io.Reader) (err error) {
 	for i := retries; i > 0; i-- {
-		err = put(requestURI, baseURI, reader)
+		err = put(ctx, requestURI, baseURI, reader)
 
 		// Break if we get nil / any error other than Err5xx
 		if err == nil {
@@ -57,12 +76,12 @@ func Put(requestURI, baseURI string, reader io.Reader) (err error) {
 	return err
 }
 
-func put(requestURI, baseURI string, reader io.Reader) error {
+func put(ctx context.Context, requestURI, baseURI string, reader io.Reader) error {
 	req, err := newRequest("PUT", requestURI, baseURI, reader)
 	if err != nil {
 		return err
 	}
-	res, err := process(req)
+	res, err := process(ctx, req)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -79,9 +98,15 @@ func put(requestURI, baseURI string, reader io.Reader) error {
 //   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
 //   reader, err := storage.Get(requestURI, 0)
 //
-func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error) {
+func Get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+	return GetContext(context.Background(), requestURI, baseURI, offset)
+}
+
+// GetContext is Get with requests made with ctx, and traced
+// under the span it carries, if any.
+func GetContext(ctx context.Context, requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error) {
 	for i := retries; i > 0; i-- {
-		rd, err = get(requestURI, baseURI, offset)
+		rd, err = get(ctx, requestURI, baseURI, offset)
 
 		if err == nil {
 			util.Count("storage.get.success")
@@ -107,7 +132,7 @@ func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error)
 	return rd, err
 }
 
-func get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+func get(ctx context.Context, requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
 	req, err := newRequest("GET", requestURI, baseURI, nil)
 	if err != nil {
 		return nil, err
@@ -116,11 +141,79 @@ func get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
 	req.Header.Add("Transfer-Encoding", "chunked")
 	req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
 
-	res, err := process(req)
+	res, err := process(ctx, req)
 	if res == nil {
 		return nil, err
 	}
-	return res.Body, err
+	return &archive{res.Body}, err
+}
+
+// Size returns the size in bytes of the output stored at requestURI,
+// without downloading it: only its last byte is requested.
+//
+// Retries transient errors `retries` number of times.
+func Size(ctx context.Context, requestURI, baseURI string) (size int64, err error) {
+	for i := retries; i > 0; i-- {
+		size, err = sizeOf(ctx, requestURI, baseURI)
+		if err != Err5xx {
+			return size, err
+		}
+		util.Count("storage.size.retry")
+	}
+
+	// We've ran out of retries
+	util.Count("storage.size.maxretries")
+	return size, err
+}
+
+func sizeOf(ctx context.Context, requestURI, baseURI string) (int64, error) {
+	req, err := newRequest("GET", requestURI, baseURI, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Range", "bytes=-1")
+
+	res, err := process(ctx, req)
+	if res != nil {
+		res.Body.Close()
+	}
+	if err == ErrRange {
+		// Nothing was stored.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Servers ignoring ranges send everything.
+	if res.StatusCode != http.StatusPartialContent {
+		if res.ContentLength < 0 {
+			return 0, errUnknownSize
+		}
+		return res.ContentLength, nil
+	}
+
+	// Content-Range: bytes <first>-<last>/<size>
+	contentRange := res.Header.Get("Content-Range")
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return 0, errUnknownSize
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, errUnknownSize
+	}
+	return size, nil
+}
+
+// archive is the body of stored output.
+type archive struct {
+	io.ReadCloser
+}
+
+// State always returns `archived`: stored output is complete.
+func (a *archive) State() string {
+	return "archived"
 }
 
 // constructs an http.Request object, resolving requestURI
@@ -134,6 +227,17 @@ func newRequest(method, requestURI, baseURI string, reader io.Reader) (*http.Req
 	return http.NewRequest(method, u.String(), reader)
 }
 
+// Location returns the URL requestURI is stored at under baseURI,
+// without its query, which may hold presigned credentials.
+func Location(requestURI, baseURI string) (string, error) {
+	u, err := absoluteURL(baseURI, requestURI)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
 // Executes the HTTP request:
 // Errors:
 //
@@ -141,11 +245,31 @@ func newRequest(method, requestURI, baseURI string, reader io.Reader) (*http.Req
 //   - Err4xx
 //   - ErrRange
 //
-func process(req *http.Request) (*http.Response, error) {
+func process(ctx context.Context, req *http.Request) (*http.Response, error) {
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
 
+	req = req.WithContext(ctx)
+	span := trace.Start(trace.FromContext(ctx), "storage.process")
+	span.SetAttribute("method", req.Method)
+	trace.Inject(req, span.Context)
+
+	start := time.Now()
 	res, err := client.Do(req)
+	defer func() {
+		requestLatency.Observe(time.Since(start).Seconds(), req.Method)
+		requests.Inc(req.Method, result(err))
+
+		var status interface{}
+		if res != nil {
+			status = res.StatusCode
+			span.SetAttribute("status", strconv.Itoa(res.StatusCode))
+		}
+		util.Debug("storage.request", "method", req.Method, "path", req.URL.Path, "status", status, "duration", time.Since(start), "error", err)
+		span.SetError(err)
+		span.Finish()
+	}()
+
 	if err == nil {
 		switch {
 		case res.StatusCode == 416:
@@ -161,6 +285,21 @@ func process(req *http.Request) (*http.Response, error) {
 	return res, err
 }
 
+// Labels a request's outcome for metrics.
+func result(err error) string {
+	switch err {
+	case nil:
+		return "success"
+	case ErrRange:
+		return "range"
+	case ErrNotFound:
+		return "not_found"
+	case Err5xx:
+		return "5xx"
+	}
+	return "error"
+}
+
 func absoluteURL(baseURI, requestURI string) (*url.URL, error) {
 	if ref, err := url.ParseRequestURI(normalize(requestURI)); err != nil {
 		return nil, err
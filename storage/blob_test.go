@@ -1,14 +1,18 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
 
+	"github.com/heroku/busl/trace"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,6 +43,13 @@ func Example_empty_storage_base_url() {
 	// <nil> No storage defined
 }
 
+func ExampleLocation() {
+	fmt.Println(Location("1/2/3?X-Amz-Signature=secret", "https://bucket.s3.amazonaws.com"))
+
+	//Output:
+	// https://bucket.s3.amazonaws.com/1/2/3 <nil>
+}
+
 func TestPutConnRefused(t *testing.T) {
 	err := Put("1/2/3", "http://localhost:0", nil)
 	assert.Error(t, err)
@@ -108,3 +119,53 @@ func TestGetIllegalOffset(t *testing.T) {
 		t.Fatalf("%v != Expected 200, got 416", err)
 	}
 }
+
+func TestSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bytes=-1", r.Header.Get("Range"))
+		switch r.URL.Path {
+		case "/partial":
+			w.Header().Set("Content-Range", "bytes 4-4/5")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "o")
+		case "/whole":
+			io.WriteString(w, "hello")
+		case "/empty":
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for path, expected := range map[string]int64{"partial": 5, "whole": 5, "empty": 0} {
+		size, err := Size(context.Background(), path, server.URL)
+		assert.Nil(t, err, path)
+		assert.Equal(t, expected, size, path)
+	}
+
+	_, err := Size(context.Background(), "missing", server.URL)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestGetContext(t *testing.T) {
+	parent := trace.Start(trace.SpanContext{}, "test").Context
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, parent.TraceID, trace.FromRequest(r).TraceID)
+		io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+
+	rd, err := GetContext(trace.NewContext(context.Background(), parent), "1/2/3", server.URL, 0)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(rd)
+	rd.Close()
+	assert.Equal(t, "hello", string(body))
+
+	// Requests are made with the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = GetContext(ctx, "1/2/3", server.URL, 0)
+	assert.NotNil(t, err)
+}
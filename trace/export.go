@@ -0,0 +1,172 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Exporter ships finished spans somewhere.
+type Exporter interface {
+	Export(s *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter sets where spans are exported, nil to drop them.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	exporter = e
+	exporterMu.Unlock()
+}
+
+func currentExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+// record is the JSON form of a span.
+type record struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_span_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Duration   float64           `json:"duration_ms"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func newRecord(s *Span) record {
+	s.Lock()
+	defer s.Unlock()
+
+	rec := record{
+		TraceID:  s.Context.TraceID.String(),
+		SpanID:   s.Context.SpanID.String(),
+		Name:     s.Name,
+		Start:    s.Start,
+		End:      s.End,
+		Duration: float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+		Error:    s.Error,
+	}
+	if s.Parent != (SpanID{}) {
+		rec.ParentID = s.Parent.String()
+	}
+	if len(s.Attributes) > 0 {
+		rec.Attributes = make(map[string]string, len(s.Attributes))
+		for k, v := range s.Attributes {
+			rec.Attributes[k] = v
+		}
+	}
+	return rec
+}
+
+// JSONExporter writes every span as a line of JSON, e.g. to stdout.
+type JSONExporter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewJSONExporter creates an exporter writing to w.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// Export writes the span.
+func (e *JSONExporter) Export(s *Span) {
+	buf, err := json.Marshal(newRecord(s))
+	if err != nil {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.w.Write(append(buf, '\n'))
+}
+
+// Spans are sent to collectors in batches of up to batchSize,
+// at least every flushInterval. Spans are dropped rather than
+// slowing busl down when the collector can't keep up.
+const (
+	batchSize     = 100
+	queueSize     = 10 * batchSize
+	flushInterval = time.Second
+)
+
+// HTTPExporter POSTs batches of spans to a collector as a
+// JSON array.
+type HTTPExporter struct {
+	url    string
+	client *http.Client
+	queue  chan record
+}
+
+// NewHTTPExporter creates an exporter sending spans to url.
+func NewHTTPExporter(url string) *HTTPExporter {
+	e := &HTTPExporter{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan record, queueSize),
+	}
+	go e.loop()
+	return e
+}
+
+// Export queues the span.
+func (e *HTTPExporter) Export(s *Span) {
+	select {
+	case e.queue <- newRecord(s):
+	default:
+		log.Printf("count#trace.export.dropped=1")
+	}
+}
+
+func (e *HTTPExporter) loop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]record, 0, batchSize)
+	for {
+		select {
+		case rec := <-e.queue:
+			if batch = append(batch, rec); len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *HTTPExporter) send(batch []record) {
+	buf, err := json.Marshal(batch)
+	if err != nil {
+		return
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		log.Printf("count#trace.export.error=1 error=%v", err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		log.Printf("count#trace.export.error=1 status=%d", res.StatusCode)
+	}
+}
@@ -0,0 +1,188 @@
+// Package trace records spans of work, propagates them between
+// services with W3C `traceparent` headers and exports them.
+package trace
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace, i.e. every span of a request.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext is what's propagated of a span to its children.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid tells whether the context belongs to a span. The zero
+// value doesn't, and starting a span under it starts a new trace.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent formats the context as a `traceparent` header.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceParent parses a `traceparent` header, returning the
+// zero SpanContext if it is malformed.
+func ParseTraceParent(val string) SpanContext {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(val), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}
+	}
+
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil ||
+		len(traceID) != len(sc.TraceID) || len(spanID) != len(sc.SpanID) || len(flags) != 1 {
+		return SpanContext{}
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// FromRequest returns the span context propagated with a request.
+func FromRequest(r *http.Request) SpanContext {
+	return ParseTraceParent(r.Header.Get("traceparent"))
+}
+
+// Inject propagates a span context with a request.
+func Inject(r *http.Request, sc SpanContext) {
+	if sc.IsValid() {
+		r.Header.Set("traceparent", sc.TraceParent())
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying sc.
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by ctx, if any.
+func FromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(contextKey{}).(SpanContext)
+	return sc
+}
+
+// Span is a timed unit of work.
+type Span struct {
+	sync.Mutex
+	Name       string
+	Context    SpanContext
+	Parent     SpanID // zero for the root span of a trace
+	Start, End time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// Start starts a span under parent, or the first span
+// of a new, sampled trace if parent isn't valid.
+func Start(parent SpanContext, name string) *Span {
+	s := &Span{Name: name, Start: time.Now()}
+
+	if parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.Parent = parent.SpanID
+	} else {
+		ids.read(s.Context.TraceID[:])
+		s.Context.Sampled = true
+	}
+	ids.read(s.Context.SpanID[:])
+	return s
+}
+
+// SetAttribute annotates the span.
+func (s *Span) SetAttribute(key, value string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// SetError records that the work failed, if err isn't nil.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.Lock()
+	s.Error = err.Error()
+	s.Unlock()
+}
+
+// Finish ends the span and exports it if it is sampled.
+func (s *Span) Finish() {
+	s.Lock()
+	s.End = time.Now()
+	s.Unlock()
+
+	if e := currentExporter(); e != nil && s.Context.Sampled {
+		e.Export(s)
+	}
+}
+
+// idSource generates span and trace IDs. They need to be
+// unique rather than unpredictable, so math/rand will do.
+type idSource struct {
+	sync.Mutex
+	rand *rand.Rand
+}
+
+var ids = newIDSource()
+
+func newIDSource() *idSource {
+	var seed [8]byte
+	crand.Read(seed[:])
+	return &idSource{rand: rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))}
+}
+
+func (s *idSource) read(p []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	for {
+		s.rand.Read(p)
+		for _, b := range p {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
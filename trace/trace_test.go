@@ -0,0 +1,110 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	sc := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, sc.IsValid())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.TraceParent())
+
+	sc = ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.False(t, sc.Sampled)
+
+	// Later versions may add fields.
+	assert.True(t, ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what").IsValid())
+
+	for _, val := range []string{
+		"",
+		"garbage",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+	} {
+		assert.False(t, ParseTraceParent(val).IsValid(), val)
+	}
+}
+
+func TestStart(t *testing.T) {
+	root := Start(SpanContext{}, "root")
+	assert.True(t, root.Context.IsValid())
+	assert.True(t, root.Context.Sampled)
+	assert.Equal(t, SpanID{}, root.Parent)
+
+	child := Start(root.Context, "child")
+	assert.Equal(t, root.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t, root.Context.SpanID, child.Parent)
+	assert.NotEqual(t, root.Context.SpanID, child.Context.SpanID)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	Inject(r, child.Context)
+	assert.Equal(t, child.Context, FromRequest(r))
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	SetExporter(NewJSONExporter(&buf))
+	defer SetExporter(nil)
+
+	span := Start(SpanContext{}, "work")
+	span.SetAttribute("key", "1/2/3")
+	span.SetError(errors.New("boom"))
+	span.Finish()
+
+	unsampled := Start(ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), "skipped")
+	unsampled.Finish()
+
+	var rec record
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, "work", rec.Name)
+	assert.Equal(t, span.Context.TraceID.String(), rec.TraceID)
+	assert.Equal(t, "", rec.ParentID)
+	assert.Equal(t, map[string]string{"key": "1/2/3"}, rec.Attributes)
+	assert.Equal(t, "boom", rec.Error)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func TestHTTPExporter(t *testing.T) {
+	batches := make(chan []record, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []record
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &batch)
+		batches <- batch
+	}))
+	defer server.Close()
+
+	e := NewHTTPExporter(server.URL)
+	parent := Start(SpanContext{}, "parent")
+	child := Start(parent.Context, "child")
+	child.Finish()
+	parent.Finish()
+	e.Export(child)
+	e.Export(parent)
+
+	select {
+	case batch := <-batches:
+		assert.Equal(t, 2, len(batch))
+		assert.Equal(t, "child", batch[0].Name)
+		assert.Equal(t, parent.Context.SpanID.String(), batch[0].ParentID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("spans weren't exported")
+	}
+}
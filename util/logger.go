@@ -1,20 +1,30 @@
 package util
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const prefix = "busl"
 const defaultDomain = "development"
 
 func init() {
-	log.SetPrefix(fmt.Sprintf("%s source=%s pid=%v ", prefix, source(), os.Getpid()))
+	log.SetPrefix(logPrefix())
 	log.SetFlags(0)
 }
 
+func logPrefix() string {
+	return fmt.Sprintf("%s source=%s pid=%v ", prefix, source(), os.Getpid())
+}
+
 func env(key, fallback string) (val string) {
 	if val = os.Getenv(key); val == "" {
 		val = fallback
@@ -41,3 +51,287 @@ func source() string {
 	domain := env("DOMAIN", defaultDomain)
 	return reverseDNS(fmt.Sprintf("%s.%s", prefix, domain))
 }
+
+// Level is the severity of a log line.
+type Level int
+
+// known levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(val string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(val, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level '%s'", val)
+}
+
+var errLogFormat = errors.New("Unknown log format, expected logfmt or json")
+
+// logger writes log lines either in logfmt, through the standard
+// logger and its prefix, or as JSON objects.
+type logger struct {
+	sync.Mutex
+	level Level
+	json  io.Writer // where JSON lines go, nil in logfmt mode
+}
+
+var std = &logger{level: LevelInfo}
+
+// SetLogLevel drops log lines below level.
+func SetLogLevel(level Level) {
+	std.Lock()
+	std.level = level
+	std.Unlock()
+}
+
+// SetLogFormat switches between `logfmt` lines (the default) and
+// `json` objects. In JSON mode, lines logged with the standard
+// logger are turned into JSON objects too.
+func SetLogFormat(format string) error {
+	std.Lock()
+	defer std.Unlock()
+
+	switch format {
+	case "", "logfmt":
+		if std.json != nil {
+			log.SetOutput(std.json)
+			log.SetPrefix(logPrefix())
+			std.json = nil
+		}
+	case "json":
+		if std.json == nil {
+			std.json = log.Writer()
+			log.SetOutput(plainLines{})
+			log.SetPrefix("")
+		}
+	default:
+		return errLogFormat
+	}
+	return nil
+}
+
+// Debug logs a message with key value pairs, e.g.
+//
+//     util.Debug("broker.fetch", "key", key, "offset", offset)
+//
+// Pairs with a nil value, e.g. a nil error, are left out.
+func Debug(msg string, kv ...interface{}) { std.log(LevelDebug, msg, kv) }
+
+// Info logs a message with key value pairs.
+func Info(msg string, kv ...interface{}) { std.log(LevelInfo, msg, kv) }
+
+// Warn logs a message with key value pairs.
+func Warn(msg string, kv ...interface{}) { std.log(LevelWarn, msg, kv) }
+
+// Error logs a message with key value pairs.
+func Error(msg string, kv ...interface{}) { std.log(LevelError, msg, kv) }
+
+// Fatal logs an error and exits.
+func Fatal(msg string, kv ...interface{}) {
+	std.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *logger) log(level Level, msg string, kv []interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	if l.json != nil {
+		l.writeJSON(level, msg, kv)
+		return
+	}
+	l.writeLogfmt(level, msg, kv)
+}
+
+// Logs line, laid out by the caller, followed by the key value
+// pairs in logfmt, whatever the format.
+func (l *logger) logLine(level Level, line string, kv []interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	if level >= l.level {
+		l.writeLogfmt(level, line, kv)
+	}
+}
+
+// Whether lines are logged as JSON objects.
+func (l *logger) jsonMode() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.json != nil
+}
+
+// Writes line, laid out by the caller, followed by the key
+// value pairs in logfmt. The logger must be locked.
+func (l *logger) writeLogfmt(level Level, line string, kv []interface{}) {
+	var buf []byte
+	if level != LevelInfo {
+		buf = append(buf, "level="+level.String()+" "...)
+	}
+	buf = append(buf, line...)
+	for i := 0; i < len(kv); i += 2 {
+		if value(kv, i+1) == nil {
+			continue
+		}
+		buf = append(buf, ' ')
+		buf = append(buf, fmt.Sprint(kv[i])...)
+		buf = append(buf, '=')
+		buf = append(buf, logfmtValue(value(kv, i+1))...)
+	}
+	log.Print(string(buf))
+}
+
+// Logs a count, see CountWithData, whatever the level. The
+// logfmt form is parsed by librato, so it's kept as is.
+func (l *logger) count(metric string, count int64, extra string) {
+	if !l.jsonMode() {
+		if extra == "" {
+			log.Printf("count#%s=%d", metric, count)
+		} else {
+			log.Printf("count#%s=%d %s", metric, count, extra)
+		}
+		return
+	}
+
+	kv := append([]interface{}{"metric", metric, "count", count}, parseLogfmt(extra)...)
+	l.Lock()
+	l.writeJSON(LevelInfo, "count", kv)
+	l.Unlock()
+}
+
+// Keys every JSON line has.
+var reservedKeys = map[string]bool{"time": true, "level": true, "source": true, "pid": true, "msg": true}
+
+// Writes a JSON line. The logger must be locked.
+func (l *logger) writeJSON(level Level, msg string, kv []interface{}) {
+	line := map[string]interface{}{
+		"time":   time.Now().UTC().Format(time.RFC3339Nano),
+		"level":  level.String(),
+		"source": source(),
+		"pid":    os.Getpid(),
+		"msg":    msg,
+	}
+	for i := 0; i < len(kv); i += 2 {
+		v := value(kv, i+1)
+		if v == nil {
+			continue
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		if d, ok := v.(time.Duration); ok {
+			v = d.Seconds()
+		}
+		key := fmt.Sprint(kv[i])
+		if reservedKeys[key] {
+			// e.g. a count's msg, the line's msg being "count".
+			key = "field_" + key
+		}
+		line[key] = v
+	}
+
+	buf, err := json.Marshal(line)
+	if err != nil {
+		buf, _ = json.Marshal(map[string]string{"level": "error", "msg": msg, "error": err.Error()})
+	}
+	l.json.Write(append(buf, '\n'))
+}
+
+func value(kv []interface{}, i int) interface{} {
+	if i < len(kv) {
+		return kv[i]
+	}
+	return ""
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case time.Duration:
+		s = strconv.FormatFloat(v.Seconds(), 'f', -1, 64)
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " \"=\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Parses `key=value key="quoted value"` pairs.
+func parseLogfmt(s string) (kv []interface{}) {
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		eq := strings.IndexAny(s, "= ")
+		if eq < 0 || s[eq] == ' ' {
+			// A bare word, e.g. a message.
+			end := eq
+			if end < 0 {
+				end = len(s)
+			}
+			kv = append(kv, "msg", s[:end])
+			s = s[end:]
+			continue
+		}
+
+		key, rest := s[:eq], s[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			if unquoted, err := strconv.QuotedPrefix(rest); err == nil {
+				val, _ = strconv.Unquote(unquoted)
+				rest = rest[len(unquoted):]
+				kv = append(kv, key, val)
+				s = rest
+				continue
+			}
+		}
+
+		end := strings.IndexByte(rest, ' ')
+		if end < 0 {
+			end = len(rest)
+		}
+		kv = append(kv, key, rest[:end])
+		s = rest[end:]
+	}
+	return kv
+}
+
+// plainLines turns lines logged with the standard
+// logger into JSON objects, in JSON mode.
+type plainLines struct{}
+
+func (plainLines) Write(p []byte) (int, error) {
+	std.Lock()
+	defer std.Unlock()
+
+	if std.json == nil {
+		return len(p), nil
+	}
+	std.writeJSON(LevelInfo, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func captureLogs(f func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	f()
+	return buf.String()
+}
+
+func TestLogfmt(t *testing.T) {
+	out := captureLogs(func() {
+		Info("http.request", "path", "/streams/1 2", "status", 200, "error", nil)
+		Warn("broker.write", "duration", 1500*time.Millisecond, "error", errors.New("boom"))
+		Debug("dropped")
+		CountWithData("server.pub", 1, "key=%s", "1/2/3")
+	})
+
+	assert.Equal(t, logPrefix()+"http.request path=\"/streams/1 2\" status=200\n"+
+		logPrefix()+"level=warn broker.write duration=1.5 error=boom\n"+
+		logPrefix()+"count#server.pub=1 key=1/2/3\n", out)
+}
+
+func TestJSON(t *testing.T) {
+	var lines []map[string]interface{}
+	out := captureLogs(func() {
+		assert.Nil(t, SetLogFormat("json"))
+		defer SetLogFormat("logfmt")
+
+		Info("http.request", "path", "/streams/1", "status", 200, "error", nil)
+		CountWithData("server.pub", 1, "key=%s msg=\"%s\"", "1/2/3", "a b")
+		log.Printf("plain line")
+		assert.Equal(t, errLogFormat, SetLogFormat("xml"))
+	})
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var obj map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &obj), line)
+		lines = append(lines, obj)
+	}
+	if !assert.Equal(t, 3, len(lines)) {
+		return
+	}
+
+	assert.Equal(t, "http.request", lines[0]["msg"])
+	assert.Equal(t, "info", lines[0]["level"])
+	assert.Equal(t, "/streams/1", lines[0]["path"])
+	assert.Equal(t, float64(200), lines[0]["status"])
+	_, ok := lines[0]["error"]
+	assert.False(t, ok)
+
+	assert.Equal(t, "count", lines[1]["msg"])
+	assert.Equal(t, "server.pub", lines[1]["metric"])
+	assert.Equal(t, "1/2/3", lines[1]["key"])
+	assert.Equal(t, "a b", lines[1]["field_msg"])
+
+	assert.Equal(t, "plain line", lines[2]["msg"])
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarn, level)
+
+	_, err = ParseLevel("loud")
+	assert.NotNil(t, err)
+}
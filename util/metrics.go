@@ -2,9 +2,16 @@ package util
 
 import (
 	"fmt"
-	"log"
+
+	"github.com/heroku/busl/metrics"
 )
 
+// LogCounts controls whether counts are logged for librato in
+// addition to being kept as `busl_events_total` metrics.
+var LogCounts = true
+
+var events = metrics.NewCounter("busl_events_total", "Events counted with util.Count, by name.", "event")
+
 // Count parses a string into a count for logging to librato
 func Count(metric string) { CountMany(metric, 1) }
 
@@ -13,9 +20,16 @@ func CountMany(metric string, count int64) { CountWithData(metric, count, "") }
 
 // CountWithData parses metrics for logging to librato
 func CountWithData(metric string, count int64, extraData string, v ...interface{}) {
-	if extraData == "" {
-		log.Printf("count#%s=%d", metric, count)
-	} else {
-		log.Printf("count#%s=%d %s", metric, count, fmt.Sprintf(extraData, v...))
+	if count > 0 {
+		events.Add(float64(count), metric)
+	}
+
+	if !LogCounts {
+		return
+	}
+
+	if extraData != "" {
+		extraData = fmt.Sprintf(extraData, v...)
 	}
+	std.count(metric, count, extraData)
 }
@@ -1,21 +1,56 @@
 package util
 
 import (
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
+
+	"github.com/heroku/busl/trace"
 )
 
 // NewResponseLogger creates a new logger for HTTP responses
 func NewResponseLogger(r *http.Request, w http.ResponseWriter) *ResponseLogger {
-	return &ResponseLogger{ResponseWriter: w, request: r, status: http.StatusOK}
+	return &ResponseLogger{ResponseWriter: w, request: r, status: http.StatusOK, start: time.Now()}
 }
 
 // ResponseLogger is a logger for HTTP responses
 type ResponseLogger struct {
 	http.ResponseWriter
-	request *http.Request
-	status  int
+	request   *http.Request
+	status    int
+	principal string
+	start     time.Time
+	bytes     int64
+	fields    []interface{}
+}
+
+// SetPrincipal records who the request was authenticated as
+func (l *ResponseLogger) SetPrincipal(name string) {
+	l.principal = name
+}
+
+// Principal returns who the request was authenticated as, if anyone
+func (l *ResponseLogger) Principal() string {
+	return l.principal
+}
+
+// Status returns the response's status code
+func (l *ResponseLogger) Status() int {
+	return l.status
+}
+
+// Annotate adds key value pairs to the response's log line,
+// e.g. the offset a stream was read from.
+func (l *ResponseLogger) Annotate(kv ...interface{}) {
+	l.fields = append(l.fields, kv...)
+}
+
+// Write writes to the response, counting the bytes written
+func (l *ResponseLogger) Write(p []byte) (int, error) {
+	n, err := l.ResponseWriter.Write(p)
+	l.bytes += int64(n)
+	return n, err
 }
 
 // WriteHeader writes a new header to the response
@@ -29,16 +64,27 @@ func (l *ResponseLogger) CloseNotify() <-chan bool {
 	return l.ResponseWriter.(http.CloseNotifier).CloseNotify()
 }
 
+// Unwrap returns the underlying ResponseWriter, e.g. for
+// an http.ResponseController
+func (l *ResponseLogger) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
 // Flush flushes the response
 func (l *ResponseLogger) Flush() {
 	l.ResponseWriter.(http.Flusher).Flush()
 }
 
-func (l *ResponseLogger) requestID() (id string) {
+// RequestID returns the request's Request-Id, falling back to its trace ID
+func (l *ResponseLogger) RequestID() (id string) {
 	if id = l.request.Header.Get("Request-Id"); id == "" {
 		id = l.request.Header.Get("X-Request-Id")
 	}
 
+	if sc := trace.FromContext(l.request.Context()); id == "" && sc.IsValid() {
+		id = sc.TraceID.String()
+	}
+
 	if id == "" {
 		// In the event of a rare case where uuid
 		// generation fails, it's probably more
@@ -52,10 +98,42 @@ func (l *ResponseLogger) requestID() (id string) {
 	return id
 }
 
-// WriteLog logs the response
+func (l *ResponseLogger) traceID() string {
+	if sc := trace.FromContext(l.request.Context()); sc.IsValid() {
+		return sc.TraceID.String()
+	}
+	return ""
+}
+
+// WriteLog logs the response. In logfmt mode, the line keeps the
+// layout it always had, which log drains parse, the fields added
+// since following it; JSON lines are an `http.request` message.
 func (l *ResponseLogger) WriteLog() {
 	maskedStatus := strconv.Itoa(l.status/100) + "xx"
-	log.Printf("count#http.status.%s=1 request_id=%s", maskedStatus, l.requestID())
-	log.Printf("method=%s path=\"%s\" host=\"%s\" fwd=\"%s\" status=%d user_agent=\"%s\" request_id=%s",
-		l.request.Method, l.request.URL.Path, l.request.Host, l.request.Header.Get("X-Forwarded-For"), l.status, l.request.UserAgent(), l.requestID())
+	requestID := l.RequestID()
+	std.count("http.status."+maskedStatus, 1, "request_id="+requestID)
+
+	extra := append([]interface{}{
+		"principal", l.principal,
+		"trace_id", l.traceID(),
+		"bytes", l.bytes,
+		"duration", time.Since(l.start),
+	}, l.fields...)
+
+	if std.jsonMode() {
+		Info("http.request", append([]interface{}{
+			"method", l.request.Method,
+			"path", l.request.URL.Path,
+			"host", l.request.Host,
+			"fwd", l.request.Header.Get("X-Forwarded-For"),
+			"status", l.status,
+			"user_agent", l.request.UserAgent(),
+			"request_id", requestID,
+		}, extra...)...)
+		return
+	}
+
+	line := fmt.Sprintf("method=%s path=\"%s\" host=\"%s\" fwd=\"%s\" status=%d user_agent=\"%s\" request_id=%s",
+		l.request.Method, l.request.URL.Path, l.request.Host, l.request.Header.Get("X-Forwarded-For"), l.status, l.request.UserAgent(), requestID)
+	std.logLine(LevelInfo, line, extra)
 }
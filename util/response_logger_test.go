@@ -0,0 +1,41 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteLog(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/streams/1", nil)
+	r.Header.Set("Request-Id", "abc")
+	r.Header.Set("User-Agent", "curl")
+
+	logger := NewResponseLogger(r, httptest.NewRecorder())
+	logger.Annotate("key", "1")
+	out := captureLogs(logger.WriteLog)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Equal(t, logPrefix()+"count#http.status.2xx=1 request_id=abc", lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], logPrefix()+`method=GET path="/streams/1" host="example.com" fwd="" status=200 user_agent="curl" request_id=abc principal="" `), lines[1])
+		assert.True(t, strings.HasSuffix(lines[1], " key=1"), lines[1])
+	}
+
+	out = captureLogs(func() {
+		assert.Nil(t, SetLogFormat("json"))
+		defer SetLogFormat("logfmt")
+		logger.WriteLog()
+	})
+
+	var line map[string]interface{}
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	if assert.Equal(t, 2, len(lines)) && assert.Nil(t, json.Unmarshal([]byte(lines[1]), &line)) {
+		assert.Equal(t, "http.request", line["msg"])
+		assert.Equal(t, "/streams/1", line["path"])
+		assert.Equal(t, "1", line["key"])
+	}
+}
@@ -0,0 +1,189 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+// Events of a stream's lifecycle.
+const (
+	Created   = "stream.created"    // registered by mkstream or put
+	FirstByte = "stream.first_byte" // its first byte was published
+	Completed = "stream.completed"  // its writer closed it
+	Archived  = "stream.archived"   // its output was stored
+	Expired   = "stream.expired"    // it expired from the broker
+)
+
+// Event is the JSON payload sent to webhooks.
+type Event struct {
+	Event    string    `json:"event"`
+	Key      string    `json:"key"`
+	Bytes    int64     `json:"bytes"`
+	Location string    `json:"location,omitempty"` // where the output was stored
+	Time     time.Time `json:"time"`
+}
+
+// Deliveries are retried up to maxAttempts times, backing off
+// from minBackoff, doubling up to maxBackoff. They're dropped
+// rather than slowing busl down when receivers can't keep up.
+var (
+	maxAttempts = 6
+	minBackoff  = time.Second
+	maxBackoff  = time.Minute
+)
+
+const (
+	queueSize = 1000
+	workers   = 4
+)
+
+// Notifier POSTs events to webhook URLs, signed with a secret
+// shared with the receivers.
+type Notifier struct {
+	urls   []string
+	secret string
+	client *http.Client
+	queue  chan *delivery
+}
+
+type delivery struct {
+	url      string
+	id       string
+	event    string
+	body     []byte
+	attempts int
+}
+
+// New creates a notifier sending events to every one of urls.
+func New(urls []string, secret string) *Notifier {
+	n := &Notifier{
+		urls:   urls,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *delivery, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go n.loop()
+	}
+	return n
+}
+
+// Sign returns the signature of a delivery's body sent at timestamp,
+// as in its `Busl-Signature` header:
+//
+//   sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// timestamp is its `Busl-Timestamp` header.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify queues the event for every webhook. It does nothing
+// on a nil Notifier, i.e. without webhooks.
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	for _, url := range n.urls {
+		id, _ := util.NewUUID()
+		n.enqueue(&delivery{url: url, id: id, event: e.Event, body: body})
+	}
+}
+
+func (n *Notifier) enqueue(d *delivery) {
+	select {
+	case n.queue <- d:
+	default:
+		util.CountWithData("webhook.dropped", 1, "event=%s", d.event)
+	}
+}
+
+func (n *Notifier) loop() {
+	for d := range n.queue {
+		n.deliver(d)
+	}
+}
+
+func (n *Notifier) deliver(d *delivery) {
+	d.attempts++
+	retry, err := n.post(d)
+	if err == nil {
+		util.CountWithData("webhook.delivered", 1, "event=%s", d.event)
+		return
+	}
+
+	if !retry || d.attempts >= maxAttempts {
+		util.CountWithData("webhook.failed", 1, "event=%s url=%q error=%q", d.event, d.url, err)
+		return
+	}
+	util.CountWithData("webhook.retry", 1, "event=%s error=%q", d.event, err)
+
+	// Waiting elsewhere keeps the workers free for other deliveries.
+	time.AfterFunc(backoff(d.attempts), func() { n.enqueue(d) })
+}
+
+// Returns how long to wait after the given number of attempts.
+func backoff(attempts int) time.Duration {
+	wait := minBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+// Posts a delivery, telling whether it's worth retrying if it
+// failed: receivers rejecting it with a 4xx won't change their mind,
+// unless they timed out or asked us to slow down.
+func (n *Notifier) post(d *delivery) (retry bool, err error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "busl")
+	req.Header.Set("Busl-Event", d.event)
+	req.Header.Set("Busl-Delivery", d.id)
+	req.Header.Set("Busl-Timestamp", timestamp)
+	req.Header.Set("Busl-Signature", Sign(n.secret, timestamp, d.body))
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return false, nil
+	case res.StatusCode == http.StatusRequestTimeout, res.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("HTTP %d", res.StatusCode)
+	default:
+		return res.StatusCode/100 != 4, fmt.Errorf("HTTP %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,101 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	minBackoff = time.Millisecond
+	maxBackoff = 4 * time.Millisecond
+}
+
+func TestNotify(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	n := New([]string{server.URL}, "s3cret")
+	n.Notify(Event{Event: Archived, Key: "1/2/3", Bytes: 11, Location: "https://bucket/1/2/3"})
+
+	r, body := <-requests, <-bodies
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, Archived, r.Header.Get("Busl-Event"))
+	assert.NotEmpty(t, r.Header.Get("Busl-Delivery"))
+	assert.Equal(t, Sign("s3cret", r.Header.Get("Busl-Timestamp"), body), r.Header.Get("Busl-Signature"))
+	assert.NotEqual(t, Sign("other", r.Header.Get("Busl-Timestamp"), body), r.Header.Get("Busl-Signature"))
+
+	var e Event
+	assert.Nil(t, json.Unmarshal(body, &e))
+	assert.Equal(t, Archived, e.Event)
+	assert.Equal(t, "1/2/3", e.Key)
+	assert.Equal(t, int64(11), e.Bytes)
+	assert.Equal(t, "https://bucket/1/2/3", e.Location)
+	assert.WithinDuration(t, time.Now(), e.Time, time.Minute)
+
+	// Without webhooks, nothing happens.
+	var none *Notifier
+	none.Notify(Event{Event: Created})
+}
+
+func TestRetries(t *testing.T) {
+	attempts := make(chan string, maxAttempts)
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- r.Header.Get("Busl-Delivery")
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	n := New([]string{server.URL}, "s3cret")
+	n.Notify(Event{Event: Completed, Key: "1/2/3"})
+
+	// Retried until it succeeds, as the same delivery.
+	id := <-attempts
+	assert.Equal(t, id, <-attempts)
+	assert.Equal(t, id, <-attempts)
+	select {
+	case <-attempts:
+		t.Fatal("delivered again")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNoRetries(t *testing.T) {
+	attempts := make(chan struct{}, maxAttempts)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- struct{}{}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	n := New([]string{server.URL}, "s3cret")
+	n.Notify(Event{Event: Completed, Key: "1/2/3"})
+
+	<-attempts
+	select {
+	case <-attempts:
+		t.Fatal("retried a rejected delivery")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, minBackoff, backoff(1))
+	assert.Equal(t, 2*minBackoff, backoff(2))
+	assert.Equal(t, maxBackoff, backoff(10))
+}